@@ -0,0 +1,125 @@
+package push_handler
+
+import (
+    "net/http"
+
+    "crypto/subtle"
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+type azureDevOpsProvider struct {}
+
+// https://learn.microsoft.com/en-us/azure/devops/service-hooks/events#git.push
+type azureDevOpsPushEvent struct {
+    EventType string `json:"eventType"`
+
+    Resource struct {
+        Commits []struct {
+            CommitId string `json:"commitId"`
+            Comment  string `json:"comment"`
+        } `json:"commits"`
+
+        RefUpdates []struct {
+            Name        string `json:"name"`
+            OldObjectId string `json:"oldObjectId"`
+            NewObjectId string `json:"newObjectId"`
+        } `json:"refUpdates"`
+
+        Repository struct {
+            Name      string `json:"name"`
+            RemoteURL string `json:"remoteUrl"`
+
+            Project struct {
+                Name string `json:"name"`
+            } `json:"project"`
+        } `json:"repository"`
+
+        PushedBy struct {
+            DisplayName string `json:"displayName"`
+        } `json:"pushedBy"`
+    } `json:"resource"`
+}
+
+// azure devops can't sign payloads, but service hooks can be configured to
+// send http basic credentials.  the Vault secret holds the expected "username"
+// and, as "secret" or "secrets", the password.
+func (self *azureDevOpsProvider) Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    expectedUsername, ok := secret.Data["username"].(string)
+    if ! ok || expectedUsername == "" {
+        return newPreflightError("malformed webhook secret: no username", http.StatusInternalServerError)
+    }
+
+    expectedPasswords, err := webhookSecretsForRequest(secret)
+    if err != nil {
+        return err
+    }
+
+    username, password, ok := req.BasicAuth()
+    if ! ok {
+        return newPreflightError("no basic auth credentials", http.StatusUnauthorized)
+    }
+
+    for _, expectedPassword := range expectedPasswords {
+        // evaluate both so the comparison time doesn't reveal which one failed
+        usernameOk := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername))
+        passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword))
+
+        if usernameOk & passwordOk == 1 {
+            return nil
+        }
+    }
+
+    return newPreflightError("bad basic auth credentials", http.StatusForbidden)
+}
+
+// azure devops doesn't identify the event in a header, only in the body
+func (self *azureDevOpsProvider) EventType(req *http.Request, body []byte) forge.EventType {
+    var payload azureDevOpsPushEvent
+    if json.Unmarshal(body, &payload) == nil && payload.EventType == "git.push" {
+        return forge.EventPush
+    }
+
+    return forge.EventUnsupported
+}
+
+// each entry in resource.refUpdates is dispatched separately
+func (self *azureDevOpsProvider) Normalize(eventType forge.EventType, body []byte) ([]*forge.PushEvent, error) {
+    var payload azureDevOpsPushEvent
+    err := json.Unmarshal(body, &payload)
+    if err != nil {
+        return nil, err
+    }
+
+    // the commits aren't associated with a ref, and don't list changed paths
+    commits := []*forge.Commit{}
+    for _, commit := range payload.Resource.Commits {
+        commits = append(commits, &forge.Commit{
+            ID:      commit.CommitId,
+            Message: commit.Comment,
+        })
+    }
+
+    pushEvents := []*forge.PushEvent{}
+    for _, refUpdate := range payload.Resource.RefUpdates {
+        pushEvents = append(pushEvents, &forge.PushEvent{
+            RepoFullName: payload.Resource.Repository.Project.Name + "/" + payload.Resource.Repository.Name,
+            Pusher:       payload.Resource.PushedBy.DisplayName,
+
+            CloneURL: payload.Resource.Repository.RemoteURL,
+            Ref:      refUpdate.Name,
+            Before:   refUpdate.OldObjectId,
+            After:    refUpdate.NewObjectId,
+
+            // newObjectId is all zeros for a deleted ref
+            Deleted:  isZeroSHA(refUpdate.NewObjectId),
+
+            HeadCommit: findCommit(commits, refUpdate.NewObjectId),
+        })
+    }
+
+    return pushEvents, nil
+}
@@ -0,0 +1,185 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+// trimmed from the example in the Azure DevOps service hook docs
+var azureDevOpsPushEventExamplePayload string = `{"subscriptionId":"00000000-0000-0000-0000-000000000000","notificationId":1,"id":"03c164c2-8912-4d5e-8009-3707d5f83734","eventType":"git.push","publisherId":"tfs","message":{"text":"Jamal Hartnett pushed updates to branch master of repository Fabrikam-Fiber-Git."},"resource":{"commits":[{"commitId":"33b55f7cb7e7e245323987634f960cf4a6e6bc74","author":{"name":"Jamal Hartnett","email":"fabrikamfiber4@hotmail.com","date":"2015-02-25T19:01:00Z"},"comment":"Fixed bug in web.config file","url":"https://fabrikam-fiber-inc.visualstudio.com/DefaultCollection/_git/Fabrikam-Fiber-Git/commit/33b55f7cb7e7e245323987634f960cf4a6e6bc74"}],"refUpdates":[{"name":"refs/heads/master","oldObjectId":"aad331d8d3b131fa9ae03cf5e53965b51942618a","newObjectId":"33b55f7cb7e7e245323987634f960cf4a6e6bc74"},{"name":"refs/heads/stale","oldObjectId":"aad331d8d3b131fa9ae03cf5e53965b51942618a","newObjectId":"0000000000000000000000000000000000000000"}],"repository":{"id":"278d5cd2-584d-4b63-824a-2ba458937249","name":"Fabrikam-Fiber-Git","url":"https://fabrikam-fiber-inc.visualstudio.com/DefaultCollection/_apis/git/repositories/278d5cd2-584d-4b63-824a-2ba458937249","project":{"id":"6ce954b1-ce1f-45d1-b94d-e6bf2464ba2c","name":"Fabrikam-Fiber-Git","url":"https://fabrikam-fiber-inc.visualstudio.com/DefaultCollection/_apis/projects/6ce954b1-ce1f-45d1-b94d-e6bf2464ba2c","state":"wellFormed"},"defaultBranch":"refs/heads/master","remoteUrl":"https://fabrikam-fiber-inc.visualstudio.com/DefaultCollection/_git/Fabrikam-Fiber-Git"},"pushedBy":{"id":"00067FFED5C7AF52@Live.com","displayName":"Jamal Hartnett","uniqueName":"Windows Live ID\\fabrikamfiber4@hotmail.com"},"pushId":14,"date":"2014-05-02T19:17:13.3309587Z","url":"https://fabrikam-fiber-inc.visualstudio.com/DefaultCollection/_apis/git/repositories/278d5cd2-584d-4b63-824a-2ba458937249/pushes/14"},"resourceVersion":"1.0","createdDate":"2024-09-19T13:03:27.0379153Z"}`
+
+var _ = Describe("PushHandler for Azure DevOps", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+    endpoint := "http://example.com/notify/push/azure-devops/some-auth-token"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/azure-devops/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "username": "azure",
+                    "secret":   "s3kr1t",
+                },
+            }, nil)
+    })
+
+    newRequest := func(payload string) *http.Request {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json; charset=utf-8")
+
+        return req
+    }
+
+    It("should dispatch each updated ref", func() {
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return([]*nomadapi.JobListStub{}, &nomadapi.QueryMeta{}, nil)
+
+        req := newRequest(azureDevOpsPushEventExamplePayload)
+        req.SetBasicAuth("azure", "s3kr1t")
+
+        router.ServeHTTP(resp, req)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockVaultLogical.AssertExpectations(GinkgoT())
+        mockNomadJobs.AssertExpectations(GinkgoT())
+
+        // the deleted ref isn't dispatched
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 1)
+
+        dispatchCall := mockNomadJobs.Calls[0]
+        Expect(dispatchCall.Method).To(Equal("Dispatch"))
+
+        var dispatchPayload structs.CloneDispatchPayload
+        Expect(json.Unmarshal(dispatchCall.Arguments[2].([]byte), &dispatchPayload)).ShouldNot(HaveOccurred())
+
+        Expect(dispatchPayload).To(Equal(structs.CloneDispatchPayload{
+            CloneURL: "https://fabrikam-fiber-inc.visualstudio.com/DefaultCollection/_git/Fabrikam-Fiber-Git",
+            Ref:      "refs/heads/master",
+            SHA:      "33b55f7cb7e7e245323987634f960cf4a6e6bc74",
+        }))
+    })
+
+    It("should still dispatch the other refs when a deleted ref's jobs can't be stopped", func() {
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return(nil, nil, fmt.Errorf("connection refused"))
+
+        req := newRequest(azureDevOpsPushEventExamplePayload)
+        req.SetBasicAuth("azure", "s3kr1t")
+
+        router.ServeHTTP(resp, req)
+        Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 1)
+
+        var body map[string]interface{}
+        Expect(json.Unmarshal(resp.Body.Bytes(), &body)).ShouldNot(HaveOccurred())
+
+        Expect(body["dispatched"]).To(HaveLen(1))
+        Expect(body["failed"]).To(Equal([]interface{}{
+            map[string]interface{}{
+                "ref":    "refs/heads/stale",
+                "job_id": dispatchJobId,
+                "error":  "connection refused",
+            },
+        }))
+    })
+
+    It("should return 401 without credentials", func() {
+        router.ServeHTTP(resp, newRequest(azureDevOpsPushEventExamplePayload))
+        Expect(resp.Code).To(Equal(http.StatusUnauthorized))
+    })
+
+    It("should return 403 for invalid credentials", func() {
+        req := newRequest(azureDevOpsPushEventExamplePayload)
+        req.SetBasicAuth("azure", "wrong")
+
+        router.ServeHTTP(resp, req)
+        Expect(resp.Code).To(Equal(http.StatusForbidden))
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should acknowledge other event types without dispatching", func() {
+        req := newRequest(`{"eventType":"git.pullrequest.created","resource":{}}`)
+        req.SetBasicAuth("azure", "s3kr1t")
+
+        router.ServeHTTP(resp, req)
+        Expect(resp.Code).To(Equal(http.StatusOK))
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+})
@@ -0,0 +1,173 @@
+package push_handler
+
+import (
+    "fmt"
+    "net/http"
+
+    "crypto/sha256"
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+type bitbucketProvider struct {}
+
+// https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#Push
+// a single push can update several branches and tags; each is a separate
+// entry in push.changes.
+type bitbucketPushEvent struct {
+    Push struct {
+        Changes []bitbucketPushChange `json:"changes"`
+    } `json:"push"`
+
+    Actor struct {
+        DisplayName string `json:"display_name"`
+    } `json:"actor"`
+
+    Repository struct {
+        FullName string `json:"full_name"`
+        SCM      string `json:"scm"`
+
+        Links struct {
+            HTML struct {
+                Href string `json:"href"`
+            } `json:"html"`
+        } `json:"links"`
+    } `json:"repository"`
+}
+
+type bitbucketPushChange struct {
+    // nil when a branch or tag is deleted
+    New *bitbucketRef `json:"new"`
+
+    // nil when a branch or tag is created
+    Old *bitbucketRef `json:"old"`
+
+    Created bool `json:"created"`
+    Closed  bool `json:"closed"`
+    Forced  bool `json:"forced"`
+}
+
+type bitbucketRef struct {
+    // "branch" or "tag" for git repositories
+    Type string `json:"type"`
+    Name string `json:"name"`
+
+    Target struct {
+        Hash    string `json:"hash"`
+        Message string `json:"message"`
+    } `json:"target"`
+}
+
+// verifies the "X-Hub-Signature: sha256=<hex>" header sent by both bitbucket
+// cloud and bitbucket server
+func verifyHubSignature256(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    hmacSecrets, err := webhookSecretsForRequest(secret)
+    if err != nil {
+        return err
+    }
+
+    var hubSignature string
+    if xhs, ok := req.Header["X-Hub-Signature"]; ok {
+        hubSignature = xhs[0]
+    } else {
+        return newPreflightError("no X-Hub-Signature header", http.StatusBadRequest)
+    }
+
+    return checkSignature(sha256.New, body, hmacSecrets, "sha256=", hubSignature)
+}
+
+// bitbucket cloud webhooks can be configured with a secret, and deliveries are
+// then signed with an X-Hub-Signature header, which is required.  hooks
+// created before signing was supported can only be authenticated by the auth
+// token in the url; the Vault secret must set allow_unsigned to accept them.
+func (self *bitbucketProvider) Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    if ! hasWebhookSecrets(secret) && secretFlag(secret, "allow_unsigned") {
+        return nil
+    }
+
+    return verifyHubSignature256(req, body, secret)
+}
+
+// maps the bitbucket ref type onto a fully-qualified git ref
+func bitbucketGitRef(ref *bitbucketRef) (string, bool) {
+    switch ref.Type {
+        case "branch":
+            return "refs/heads/" + ref.Name, true
+
+        case "tag":
+            return "refs/tags/" + ref.Name, true
+    }
+
+    return "", false
+}
+
+func (self *bitbucketProvider) EventType(req *http.Request, body []byte) forge.EventType {
+    if req.Header.Get("X-Event-Key") == "repo:push" {
+        return forge.EventPush
+    }
+
+    return forge.EventUnsupported
+}
+
+// each entry in push.changes is dispatched separately
+func (self *bitbucketProvider) Normalize(eventType forge.EventType, body []byte) ([]*forge.PushEvent, error) {
+    var payload bitbucketPushEvent
+    err := json.Unmarshal(body, &payload)
+    if err != nil {
+        return nil, err
+    }
+
+    if payload.Repository.SCM != "" && payload.Repository.SCM != "git" {
+        return nil, fmt.Errorf("unsupported scm %s", payload.Repository.SCM)
+    }
+
+    // the push payload doesn't include clone links, but the html link is the
+    // same as the https clone url, sans ".git"
+    cloneURL := payload.Repository.Links.HTML.Href + ".git"
+
+    pushEvents := []*forge.PushEvent{}
+    for _, change := range payload.Push.Changes {
+        // new is nil for a deleted branch or tag, so the ref comes from old
+        target := change.New
+        if target == nil {
+            target = change.Old
+        }
+
+        if target == nil {
+            continue
+        }
+
+        ref, ok := bitbucketGitRef(target)
+        if ! ok {
+            continue
+        }
+
+        pushEvent := &forge.PushEvent{
+            RepoFullName: payload.Repository.FullName,
+            Pusher:       payload.Actor.DisplayName,
+
+            CloneURL: cloneURL,
+            Ref:      ref,
+            Deleted:  change.New == nil,
+        }
+
+        if change.Old != nil {
+            pushEvent.Before = change.Old.Target.Hash
+        }
+
+        if change.New != nil {
+            pushEvent.After = change.New.Target.Hash
+            pushEvent.HeadCommit = &forge.Commit{
+                ID:      change.New.Target.Hash,
+                Message: change.New.Target.Message,
+            }
+        }
+
+        pushEvents = append(pushEvents, pushEvent)
+    }
+
+    return pushEvents, nil
+}
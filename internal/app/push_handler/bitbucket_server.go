@@ -0,0 +1,132 @@
+package push_handler
+
+import (
+    "fmt"
+    "net/http"
+
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+type bitbucketServerProvider struct {}
+
+// https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Push
+type bitbucketServerRefsChangedEvent struct {
+    EventKey string `json:"eventKey"`
+
+    Actor struct {
+        Name string `json:"name"`
+    } `json:"actor"`
+
+    Repository struct {
+        Slug  string `json:"slug"`
+        ScmId string `json:"scmId"`
+
+        Project struct {
+            Key string `json:"key"`
+        } `json:"project"`
+
+        Links struct {
+            Clone []struct {
+                Href string `json:"href"`
+                Name string `json:"name"`
+            } `json:"clone"`
+        } `json:"links"`
+    } `json:"repository"`
+
+    Changes []bitbucketServerChange `json:"changes"`
+}
+
+type bitbucketServerChange struct {
+    Ref struct {
+        Id        string `json:"id"`
+        DisplayId string `json:"displayId"`
+        Type      string `json:"type"`
+    } `json:"ref"`
+
+    RefId    string `json:"refId"`
+    FromHash string `json:"fromHash"`
+    ToHash   string `json:"toHash"`
+
+    // ADD, UPDATE, or DELETE
+    Type string `json:"type"`
+}
+
+// bitbucket server signs the payload with the secret configured on the hook
+// https://confluence.atlassian.com/bitbucketserver/manage-webhooks-938025878.html#Managewebhooks-webhooksecrets
+func (self *bitbucketServerProvider) Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    return verifyHubSignature256(req, body, secret)
+}
+
+// returns the repository's clone link with the given name, "http" or "ssh",
+// if the payload has one
+func (self *bitbucketServerRefsChangedEvent) cloneLink(name string) (string, bool) {
+    for _, link := range self.Repository.Links.Clone {
+        if link.Name == name {
+            return link.Href, true
+        }
+    }
+
+    return "", false
+}
+
+// "Test connection" in the webhook settings sends a diagnostics:ping
+func (self *bitbucketServerProvider) EventType(req *http.Request, body []byte) forge.EventType {
+    switch req.Header.Get("X-Event-Key") {
+        case "repo:refs_changed":
+            return forge.EventPush
+
+        case "diagnostics:ping":
+            return forge.EventPing
+    }
+
+    return forge.EventUnsupported
+}
+
+// each entry in changes is dispatched separately
+func (self *bitbucketServerProvider) Normalize(eventType forge.EventType, body []byte) ([]*forge.PushEvent, error) {
+    if eventType != forge.EventPush {
+        return nil, nil
+    }
+
+    var payload bitbucketServerRefsChangedEvent
+    err := json.Unmarshal(body, &payload)
+    if err != nil {
+        return nil, err
+    }
+
+    cloneURL, ok := payload.cloneLink("http")
+    if ! ok {
+        return nil, fmt.Errorf("no http clone link for %s/%s", payload.Repository.Project.Key, payload.Repository.Slug)
+    }
+
+    // ssh access can be disabled on the server
+    sshURL, _ := payload.cloneLink("ssh")
+
+    pushEvents := []*forge.PushEvent{}
+    for _, change := range payload.Changes {
+        ref := change.Ref.Id
+        if ref == "" {
+            ref = change.RefId
+        }
+
+        pushEvents = append(pushEvents, &forge.PushEvent{
+            RepoFullName: payload.Repository.Project.Key + "/" + payload.Repository.Slug,
+            Pusher:       payload.Actor.Name,
+
+            CloneURL: cloneURL,
+            SSHURL:   sshURL,
+            Ref:      ref,
+            Before:   change.FromHash,
+            After:    change.ToHash,
+
+            // toHash is all zeros for a deleted ref
+            Deleted:  change.Type == "DELETE",
+        })
+    }
+
+    return pushEvents, nil
+}
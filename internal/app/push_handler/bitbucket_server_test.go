@@ -0,0 +1,153 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+// trimmed from the examples in the Bitbucket Server docs; a branch update, a
+// new tag and a deleted branch in a single push
+var bitbucketServerRefsChangedExamplePayload string = `{"eventKey":"repo:refs_changed","date":"2017-09-19T09:45:32+1000","actor":{"name":"admin","emailAddress":"admin@example.com","id":1,"displayName":"Administrator","active":true,"slug":"admin","type":"NORMAL"},"repository":{"slug":"repository","id":84,"name":"repository","scmId":"git","state":"AVAILABLE","forkable":true,"project":{"key":"PROJ","id":84,"name":"project","public":false,"type":"NORMAL"},"public":false,"links":{"clone":[{"href":"ssh://git@localhost:7999/proj/repository.git","name":"ssh"},{"href":"http://localhost:7990/bitbucket/scm/proj/repository.git","name":"http"}]}},"changes":[{"ref":{"id":"refs/heads/master","displayId":"master","type":"BRANCH"},"refId":"refs/heads/master","fromHash":"ecddabb624f6f5ba43816f5926e580a5f680a932","toHash":"178864a7d521b6f5e720b386b2c2b0ef8563e0dc","type":"UPDATE"},{"ref":{"id":"refs/tags/v1.0","displayId":"v1.0","type":"TAG"},"refId":"refs/tags/v1.0","fromHash":"0000000000000000000000000000000000000000","toHash":"178864a7d521b6f5e720b386b2c2b0ef8563e0dc","type":"ADD"},{"ref":{"id":"refs/heads/old-feature","displayId":"old-feature","type":"BRANCH"},"refId":"refs/heads/old-feature","fromHash":"ecddabb624f6f5ba43816f5926e580a5f680a932","toHash":"0000000000000000000000000000000000000000","type":"DELETE"}]}`
+
+var _ = Describe("PushHandler for Bitbucket Server", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+    endpoint := "http://example.com/notify/push/bitbucket-server/some-auth-token"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/bitbucket-server/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "secret": "s3kr1t",
+                },
+            }, nil)
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+
+        // the deleted branch has nothing running
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return([]*nomadapi.JobListStub{}, &nomadapi.QueryMeta{}, nil)
+    })
+
+    newRequest := func(signature string) *http.Request {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(bitbucketServerRefsChangedExamplePayload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json; charset=utf-8")
+        req.Header.Add("X-Event-Key", "repo:refs_changed")
+        req.Header.Add("X-Request-Id", "some-uuid")
+        req.Header.Add("X-Hub-Signature", signature)
+
+        return req
+    }
+
+    It("should dispatch each added or updated ref", func() {
+        router.ServeHTTP(resp, newRequest("sha256=" + hexMacSHA256("s3kr1t", bitbucketServerRefsChangedExamplePayload)))
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockVaultLogical.AssertExpectations(GinkgoT())
+
+        dispatchPayloads := []structs.CloneDispatchPayload{}
+        for _, call := range mockNomadJobs.Calls {
+            if call.Method != "Dispatch" {
+                continue
+            }
+
+            var dispatchPayload structs.CloneDispatchPayload
+            Expect(json.Unmarshal(call.Arguments[2].([]byte), &dispatchPayload)).ShouldNot(HaveOccurred())
+
+            dispatchPayloads = append(dispatchPayloads, dispatchPayload)
+        }
+
+        // the DELETE change isn't dispatched
+        Expect(dispatchPayloads).To(Equal([]structs.CloneDispatchPayload{
+            {
+                CloneURL: "http://localhost:7990/bitbucket/scm/proj/repository.git",
+                Ref:      "refs/heads/master",
+                SHA:      "178864a7d521b6f5e720b386b2c2b0ef8563e0dc",
+            },
+            {
+                CloneURL: "http://localhost:7990/bitbucket/scm/proj/repository.git",
+                Ref:      "refs/tags/v1.0",
+                SHA:      "178864a7d521b6f5e720b386b2c2b0ef8563e0dc",
+            },
+        }))
+    })
+
+    It("should return 403 for an invalid signature", func() {
+        router.ServeHTTP(resp, newRequest("sha256=" + hexMacSHA256("wrong", bitbucketServerRefsChangedExamplePayload)))
+        Expect(resp.Code).To(Equal(http.StatusForbidden))
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should return 400 for a sha1 signature", func() {
+        router.ServeHTTP(resp, newRequest("sha1=d9fd3f2b1dd74386ece71aec95df0b442b1a8e61"))
+        Expect(resp.Code).To(Equal(http.StatusBadRequest))
+    })
+
+    It("should acknowledge a ping", func() {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(`{"test": true}`))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json; charset=utf-8")
+        req.Header.Add("X-Event-Key", "diagnostics:ping")
+        req.Header.Add("X-Hub-Signature", "sha256=" + hexMacSHA256("s3kr1t", `{"test": true}`))
+
+        router.ServeHTTP(resp, req)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+})
@@ -0,0 +1,187 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+// trimmed from the examples in the Bitbucket Cloud docs; a branch update, a
+// new tag and a deleted branch in a single push
+var bitbucketPushEventExamplePayload string = `{"actor":{"display_name":"Some User","type":"user"},"repository":{"type":"repository","name":"repo","full_name":"team/repo","scm":"git","is_private":true,"links":{"html":{"href":"https://bitbucket.org/team/repo"}}},"push":{"changes":[{"new":{"type":"branch","name":"master","target":{"type":"commit","hash":"709d658dc5b6d6afcd46049c2f332ee3f515a67d"}},"old":{"type":"branch","name":"master","target":{"type":"commit","hash":"1e65c05c1d5171631d92438a13901ca7dae9618c"}},"created":false,"forced":false,"closed":false},{"new":{"type":"tag","name":"v1.2.0","target":{"type":"commit","hash":"709d658dc5b6d6afcd46049c2f332ee3f515a67d"}},"old":null,"created":true,"forced":false,"closed":false},{"new":null,"old":{"type":"branch","name":"feature","target":{"type":"commit","hash":"fe7d5d5ea1fba6ca3a1e60b06cf25e3e12e2fa32"}},"created":false,"forced":false,"closed":true}]}}`
+
+var _ = Describe("PushHandler for Bitbucket Cloud", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+    endpoint := "http://example.com/notify/push/bitbucket/some-auth-token"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+
+        // the deleted branch has nothing running
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return([]*nomadapi.JobListStub{}, &nomadapi.QueryMeta{}, nil)
+    })
+
+    newRequest := func() *http.Request {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(bitbucketPushEventExamplePayload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Event-Key", "repo:push")
+        req.Header.Add("X-Request-UUID", "some-uuid")
+
+        return req
+    }
+
+    dispatchedPayloads := func() []structs.CloneDispatchPayload {
+        payloads := []structs.CloneDispatchPayload{}
+
+        for _, call := range mockNomadJobs.Calls {
+            if call.Method != "Dispatch" {
+                continue
+            }
+
+            var dispatchPayload structs.CloneDispatchPayload
+            Expect(json.Unmarshal(call.Arguments[2].([]byte), &dispatchPayload)).ShouldNot(HaveOccurred())
+
+            payloads = append(payloads, dispatchPayload)
+        }
+
+        return payloads
+    }
+
+    Describe("without a signing secret", func() {
+        It("should reject deliveries", func() {
+            mockVaultLogical.
+                On("Read", "webhook-tokens/bitbucket/some-auth-token").
+                Return(&vaultapi.Secret{
+                    Data: map[string]interface{} {
+                        "dispatch_job_id": "other-job",
+                    },
+                }, nil)
+
+            router.ServeHTTP(resp, newRequest())
+            Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+    })
+
+    Describe("allowing unsigned deliveries", func() {
+        BeforeEach(func() {
+            mockVaultLogical.
+                On("Read", "webhook-tokens/bitbucket/some-auth-token").
+                Return(&vaultapi.Secret{
+                    Data: map[string]interface{} {
+                        "allow_unsigned": "true",
+                    },
+                }, nil)
+        })
+
+        It("should dispatch each changed ref", func() {
+            router.ServeHTTP(resp, newRequest())
+            Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+            mockVaultLogical.AssertExpectations(GinkgoT())
+
+            Expect(dispatchedPayloads()).To(Equal([]structs.CloneDispatchPayload{
+                {
+                    CloneURL: "https://bitbucket.org/team/repo.git",
+                    Ref:      "refs/heads/master",
+                    SHA:      "709d658dc5b6d6afcd46049c2f332ee3f515a67d",
+                },
+                {
+                    CloneURL: "https://bitbucket.org/team/repo.git",
+                    Ref:      "refs/tags/v1.2.0",
+                    SHA:      "709d658dc5b6d6afcd46049c2f332ee3f515a67d",
+                },
+            }))
+        })
+    })
+
+    Describe("with a signing secret", func() {
+        BeforeEach(func() {
+            mockVaultLogical.
+                On("Read", "webhook-tokens/bitbucket/some-auth-token").
+                Return(&vaultapi.Secret{
+                    Data: map[string]interface{} {
+                        "secret": "s3kr1t",
+                    },
+                }, nil)
+        })
+
+        It("should accept a valid signature", func() {
+            req := newRequest()
+            req.Header.Add("X-Hub-Signature", "sha256=" + hexMacSHA256("s3kr1t", bitbucketPushEventExamplePayload))
+
+            router.ServeHTTP(resp, req)
+            Expect(resp.Code).To(Equal(http.StatusAccepted))
+            Expect(dispatchedPayloads()).To(HaveLen(2))
+        })
+
+        It("should return 403 for an invalid signature", func() {
+            req := newRequest()
+            req.Header.Add("X-Hub-Signature", "sha256=" + hexMacSHA256("wrong", bitbucketPushEventExamplePayload))
+
+            router.ServeHTTP(resp, req)
+            Expect(resp.Code).To(Equal(http.StatusForbidden))
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+
+        It("should return 400 without a signature", func() {
+            router.ServeHTTP(resp, newRequest())
+            Expect(resp.Code).To(Equal(http.StatusBadRequest))
+        })
+    })
+})
@@ -0,0 +1,161 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+var _ = Describe("superseded build cancellation", func() {
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        ).InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    withSecretData := func(data map[string]interface{}) {
+        data["secret"] = "011746565c10e8c64df18d8724bc542da584433c"
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: data}, nil)
+    }
+
+    push := func() {
+        req, err := http.NewRequest(
+            "POST",
+            "http://example.com/notify/push/github/some-auth-token",
+            strings.NewReader(githubPushEventExamplePayload),
+        )
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
+
+        router.ServeHTTP(resp, req)
+    }
+
+    masterPayload := structs.CloneDispatchPayload{
+        CloneURL: "https://github.com/nomad-ci/push-handler-service.git",
+        Ref:      "refs/heads/master",
+        SHA:      "0000000000000000000000000000000000000001",
+    }
+
+    It("should stop older builds of the ref before dispatching", func() {
+        withSecretData(map[string]interface{} {
+            "cancel_superseded": "true",
+        })
+
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return(
+                []*nomadapi.JobListStub{
+                    {ID: dispatchJobId + "/dispatch-1", ParentID: dispatchJobId, Status: "running"},
+                    {ID: dispatchJobId + "/dispatch-2", ParentID: dispatchJobId, Status: "running"},
+                },
+                &nomadapi.QueryMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("Info", dispatchJobId + "/dispatch-1", mock.AnythingOfType("*api.QueryOptions")).
+            Return(dispatchedJob(masterPayload), &nomadapi.QueryMeta{}, nil)
+
+        // a pull request from master isn't superseded by a push to it
+        mockNomadJobs.
+            On("Info", dispatchJobId + "/dispatch-2", mock.AnythingOfType("*api.QueryOptions")).
+            Return(
+                dispatchedJob(structs.PullRequestDispatchPayload{
+                    CloneDispatchPayload: masterPayload,
+                    PullRequest:          3,
+                }),
+                &nomadapi.QueryMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("Deregister", dispatchJobId + "/dispatch-1", false, mock.AnythingOfType("*api.WriteOptions")).
+            Return("cafedead-beef-cafe-dead-beefcafedead", &nomadapi.WriteMeta{}, nil)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Deregister", 1)
+    })
+
+    It("should still dispatch if older builds can't be stopped", func() {
+        withSecretData(map[string]interface{} {
+            "cancel_superseded": true,
+        })
+
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return(nil, nil, fmt.Errorf("permission denied"))
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 1)
+    })
+
+    It("should not look for older builds unless enabled", func() {
+        withSecretData(map[string]interface{} {})
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertNotCalled(GinkgoT(), "List", mock.Anything)
+    })
+})
@@ -0,0 +1,161 @@
+package push_handler
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "text/template"
+
+    "net/url"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// which of the repository's urls is dispatched, set per token with
+// "clone_url_source"
+const (
+    CloneURLSourceHTTPS = "clone_url"
+    CloneURLSourceSSH   = "ssh_url"
+    CloneURLSourceGit   = "git_url"
+)
+
+func validateCloneURLSource(source string) error {
+    switch source {
+        case CloneURLSourceHTTPS, CloneURLSourceSSH, CloneURLSourceGit:
+            return nil
+    }
+
+    return fmt.Errorf("unknown clone url source %q", source)
+}
+
+// what "clone_url_template" is rendered with, to rewrite a url to point at a
+// mirror, like https://git.internal/{{ .Path }}
+type cloneURLTemplateData struct {
+    // the url chosen by clone_url_source
+    URL string
+
+    // the url's host and path, like "github.com" and
+    // "octocat/Hello-World.git".  scp-like ssh urls are split at the colon.
+    Host string
+    Path string
+
+    // all of the repository's urls; empty if the provider didn't send one
+    CloneURL string
+    SSHURL   string
+    GitURL   string
+}
+
+var cloneURLTemplateSample = newCloneURLTemplateData(
+    "https://github.com/octocat/Hello-World.git",
+    "https://github.com/octocat/Hello-World.git",
+    "git@github.com:octocat/Hello-World.git",
+    "git://github.com/octocat/Hello-World.git",
+)
+
+// splits a url, or an scp-like address like git@github.com:octocat/repo.git,
+// into its host and path, without the leading slash
+func splitCloneURL(cloneURL string) (string, string) {
+    if strings.Contains(cloneURL, "://") {
+        parsed, err := url.Parse(cloneURL)
+        if err != nil {
+            return "", ""
+        }
+
+        return parsed.Hostname(), strings.TrimPrefix(parsed.Path, "/")
+    }
+
+    hostPart := cloneURL
+    path := ""
+    if colon := strings.Index(cloneURL, ":"); colon >= 0 {
+        hostPart, path = cloneURL[:colon], cloneURL[colon+1:]
+    }
+
+    if at := strings.LastIndex(hostPart, "@"); at >= 0 {
+        hostPart = hostPart[at+1:]
+    }
+
+    return hostPart, strings.TrimPrefix(path, "/")
+}
+
+func newCloneURLTemplateData(chosen, cloneURL, sshURL, gitURL string) cloneURLTemplateData {
+    host, path := splitCloneURL(chosen)
+
+    return cloneURLTemplateData{
+        URL:  chosen,
+        Host: host,
+        Path: path,
+
+        CloneURL: cloneURL,
+        SSHURL:   sshURL,
+        GitURL:   gitURL,
+    }
+}
+
+// parses a clone url template and renders it with a sample url, so that
+// references to fields that don't exist are caught up front
+func ParseCloneURLTemplate(name, text string) (*template.Template, error) {
+    tmpl, err := template.New(name).Funcs(payloadTemplateFuncs).Parse(text)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := tmpl.Execute(ioutil.Discard, cloneURLTemplateSample); err != nil {
+        return nil, err
+    }
+
+    return tmpl, nil
+}
+
+// returns the url to dispatch for a repository with the given urls
+func (self *webhookConfig) chooseCloneURL(cloneURL, sshURL, gitURL string) (string, error) {
+    chosen := cloneURL
+    switch self.CloneURLSource {
+        case CloneURLSourceSSH:
+            chosen = sshURL
+
+        case CloneURLSourceGit:
+            chosen = gitURL
+    }
+
+    if chosen == "" {
+        return "", fmt.Errorf("the provider didn't send a %s", self.CloneURLSource)
+    }
+
+    if self.CloneURLTemplate == nil {
+        return chosen, nil
+    }
+
+    var rendered bytes.Buffer
+    err := self.CloneURLTemplate.Execute(&rendered, newCloneURLTemplateData(chosen, cloneURL, sshURL, gitURL))
+    if err != nil {
+        return "", err
+    }
+
+    return strings.TrimSpace(rendered.String()), nil
+}
+
+// replaces the push event's clone urls, and the pull request's base clone url,
+// with the ones chosen by the token.  this happens before anything else looks
+// at them, so jobs are matched against the urls they were dispatched with.
+func (self *webhookConfig) applyCloneURLs(pushEvent *forge.PushEvent) error {
+    var err error
+
+    if self.CloneURLSource == CloneURLSourceHTTPS && self.CloneURLTemplate == nil {
+        return nil
+    }
+
+    pushEvent.CloneURL, err = self.chooseCloneURL(pushEvent.CloneURL, pushEvent.SSHURL, pushEvent.GitURL)
+    if err != nil {
+        return err
+    }
+
+    if pr := pushEvent.PullRequest; pr != nil {
+        pr.BaseCloneURL, err = self.chooseCloneURL(pr.BaseCloneURL, pr.BaseSSHURL, pr.BaseGitURL)
+        if err != nil {
+            return fmt.Errorf("base repository: %s", err)
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,188 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "encoding/json"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+var _ = Describe("clone urls", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    withSecretData := func(data map[string]interface{}) {
+        data["secret"] = "011746565c10e8c64df18d8724bc542da584433c"
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: data}, nil)
+    }
+
+    deliver := func(event, payload string) {
+        req, err := http.NewRequest("POST", "http://example.com/notify/push/github/some-auth-token", strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", event)
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("011746565c10e8c64df18d8724bc542da584433c", payload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    dispatchedPayload := func(payload interface{}) {
+        Expect(json.Unmarshal(mockNomadJobs.Calls[0].Arguments[2].([]byte), payload)).ShouldNot(HaveOccurred())
+    }
+
+    It("should dispatch the https url by default", func() {
+        withSecretData(map[string]interface{} {})
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload structs.CloneDispatchPayload
+        dispatchedPayload(&payload)
+
+        Expect(payload.CloneURL).To(Equal("https://github.com/nomad-ci/push-handler-service.git"))
+    })
+
+    It("should dispatch the ssh url", func() {
+        withSecretData(map[string]interface{} {
+            "clone_url_source": "ssh_url",
+        })
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload structs.CloneDispatchPayload
+        dispatchedPayload(&payload)
+
+        Expect(payload.CloneURL).To(Equal("git@github.com:nomad-ci/push-handler-service.git"))
+    })
+
+    It("should dispatch the git url", func() {
+        withSecretData(map[string]interface{} {
+            "clone_url_source": "git_url",
+        })
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload structs.CloneDispatchPayload
+        dispatchedPayload(&payload)
+
+        Expect(payload.CloneURL).To(Equal("git://github.com/nomad-ci/push-handler-service.git"))
+    })
+
+    It("should rewrite the url with the template", func() {
+        withSecretData(map[string]interface{} {
+            "clone_url_source": "ssh_url",
+            "clone_url_template": "ssh://git@mirror.internal/{{ .Host }}/{{ .Path }}",
+        })
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload structs.CloneDispatchPayload
+        dispatchedPayload(&payload)
+
+        Expect(payload.CloneURL).To(Equal("ssh://git@mirror.internal/github.com/nomad-ci/push-handler-service.git"))
+    })
+
+    It("should choose the url for both repositories of a pull request", func() {
+        withSecretData(map[string]interface{} {
+            "clone_url_source": "ssh_url",
+        })
+
+        deliver("pull_request", strings.Replace(githubPullRequestEventExamplePayload, "%s", "opened", 1))
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload structs.PullRequestDispatchPayload
+        dispatchedPayload(&payload)
+
+        Expect(payload.CloneURL).To(Equal("git@github.com:forker/Hello-World.git"))
+        Expect(payload.BaseCloneURL).To(Equal("git@github.com:Codertocat/Hello-World.git"))
+    })
+
+    It("should return 500 when the provider doesn't send the url", func() {
+        withSecretData(map[string]interface{} {
+            "clone_url_source": "git_url",
+        })
+
+        deliver("pull_request", strings.Replace(githubPullRequestEventExamplePayload, "%s", "opened", 1))
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should return 500 for an unknown source", func() {
+        withSecretData(map[string]interface{} {
+            "clone_url_source": "svn_url",
+        })
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should reject templates with unknown fields", func() {
+        _, err := ParseCloneURLTemplate("clone_url_template", `https://mirror.internal/{{ .FullName }}`)
+        Expect(err).Should(MatchError(ContainSubstring("FullName")))
+    })
+})
@@ -0,0 +1,127 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+// a push deleting a branch, like `git push origin :feature`
+var githubDeletePushEventExamplePayload string = `{"ref":"refs/heads/feature","before":"ec26c3e57ca3a959ca5aad62de7213c562f8c821","after":"0000000000000000000000000000000000000000","created":false,"deleted":true,"forced":false,"base_ref":null,"compare":"https://github.com/Codertocat/Hello-World/compare/ec26c3e57ca3...000000000000","commits":[],"head_commit":null,"repository":{"id":186853002,"name":"Hello-World","full_name":"Codertocat/Hello-World","clone_url":"https://github.com/Codertocat/Hello-World.git"},"pusher":{"name":"Codertocat","email":"21031067+Codertocat@users.noreply.github.com"},"sender":{"login":"Codertocat","id":21031067}}`
+
+var _ = Describe("PushHandler for deleted refs", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+    endpoint := "http://example.com/notify/push/github/some-auth-token"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "secret": "s3kr1t",
+                },
+            }, nil)
+    })
+
+    deleteBranch := func() {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(githubDeletePushEventExamplePayload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("s3kr1t", githubDeletePushEventExamplePayload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    dispatchedBranch := func(ref string) *nomadapi.Job {
+        return dispatchedJob(structs.CloneDispatchPayload{
+            CloneURL: "https://github.com/Codertocat/Hello-World.git",
+            Ref:      ref,
+            SHA:      "ec26c3e57ca3a959ca5aad62de7213c562f8c821",
+        })
+    }
+
+    It("should stop running jobs for the ref instead of dispatching", func() {
+        mockNomadJobs.
+            On("List", mock.MatchedBy(func(q *nomadapi.QueryOptions) bool {
+                return q.Prefix == dispatchJobId + "/dispatch-"
+            })).
+            Return(
+                []*nomadapi.JobListStub{
+                    {ID: dispatchJobId + "/dispatch-1", ParentID: dispatchJobId, Status: "running"},
+                    {ID: dispatchJobId + "/dispatch-2", ParentID: dispatchJobId, Status: "dead"},
+                    {ID: dispatchJobId + "/dispatch-3", ParentID: dispatchJobId, Status: "pending"},
+                    {ID: dispatchJobId + "/dispatch-extra/dispatch-4", ParentID: dispatchJobId + "/dispatch-extra", Status: "running"},
+                },
+                &nomadapi.QueryMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("Info", dispatchJobId + "/dispatch-1", mock.AnythingOfType("*api.QueryOptions")).
+            Return(dispatchedBranch("refs/heads/feature"), &nomadapi.QueryMeta{}, nil)
+
+        mockNomadJobs.
+            On("Info", dispatchJobId + "/dispatch-3", mock.AnythingOfType("*api.QueryOptions")).
+            Return(dispatchedBranch("refs/heads/master"), &nomadapi.QueryMeta{}, nil)
+
+        mockNomadJobs.
+            On("Deregister", dispatchJobId + "/dispatch-1", false, mock.AnythingOfType("*api.WriteOptions")).
+            Return("cafedead-beef-cafe-dead-beefcafedead", &nomadapi.WriteMeta{}, nil)
+
+        deleteBranch()
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Deregister", 1)
+        mockNomadJobs.AssertNotCalled(GinkgoT(), "Dispatch", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+    })
+
+    It("should return 503 if running jobs can't be listed", func() {
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return(nil, nil, fmt.Errorf("connection refused"))
+
+        deleteBranch()
+        Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+        Expect(resp.Body.String()).To(ContainSubstring("connection refused"))
+    })
+})
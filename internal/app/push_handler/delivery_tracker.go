@@ -0,0 +1,106 @@
+package push_handler
+
+import (
+    "sync"
+    "time"
+)
+
+// remembers recent webhook deliveries, by replayKey, so a redelivery, whether a
+// retry by the provider or a replayed request, isn't dispatched twice
+type deliveryTracker struct {
+    window time.Duration
+
+    lock      sync.Mutex
+    seen      map[string]*trackedDelivery
+    lastPrune time.Time
+}
+
+type trackedDelivery struct {
+    seenAt time.Time
+
+    // set when the delivery wasn't successfully handled, so the provider can
+    // retry it
+    released bool
+
+    // the dispatches that succeeded, by dispatchKey, so that a retry only
+    // dispatches the ones that failed
+    dispatched map[string]dispatchResult
+}
+
+func newDeliveryTracker(window time.Duration) *deliveryTracker {
+    return &deliveryTracker{
+        window: window,
+        seen:   map[string]*trackedDelivery{},
+    }
+}
+
+// records the delivery.  returns false if it was already recorded within the
+// window, unless it was released.
+func (self *deliveryTracker) claim(deliveryKey string, now time.Time) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    // sweeping the whole map on every delivery is wasteful; once per minute is
+    // plenty to keep it bounded
+    if now.Sub(self.lastPrune) > time.Minute {
+        for id, delivery := range self.seen {
+            if now.Sub(delivery.seenAt) > self.window {
+                delete(self.seen, id)
+            }
+        }
+
+        self.lastPrune = now
+    }
+
+    if delivery, ok := self.seen[deliveryKey]; ok && now.Sub(delivery.seenAt) <= self.window {
+        if ! delivery.released {
+            return false
+        }
+
+        delivery.released = false
+        return true
+    }
+
+    self.seen[deliveryKey] = &trackedDelivery{
+        seenAt:     now,
+        dispatched: map[string]dispatchResult{},
+    }
+
+    return true
+}
+
+// allows a delivery that wasn't successfully handled to be retried.  the
+// dispatches that succeeded are still remembered.
+func (self *deliveryTracker) release(deliveryKey string) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if delivery, ok := self.seen[deliveryKey]; ok {
+        delivery.released = true
+    }
+}
+
+// records a successful dispatch for the delivery
+func (self *deliveryTracker) recordDispatch(deliveryKey, key string, result dispatchResult) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if delivery, ok := self.seen[deliveryKey]; ok {
+        delivery.dispatched[key] = result
+    }
+}
+
+// returns an earlier attempt's successful dispatch for the delivery, if any
+func (self *deliveryTracker) previousDispatch(deliveryKey, key string) (dispatchResult, bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    delivery, ok := self.seen[deliveryKey]
+    if ! ok {
+        return dispatchResult{}, false
+    }
+
+    result, ok := delivery.dispatched[key]
+
+    return result, ok
+}
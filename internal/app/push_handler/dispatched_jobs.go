@@ -0,0 +1,170 @@
+package push_handler
+
+import (
+    "strconv"
+
+    "encoding/json"
+
+    log "github.com/Sirupsen/logrus"
+
+    "github.com/golang/snappy"
+
+    nomadapi "github.com/hashicorp/nomad/api"
+
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// nomad names dispatched jobs <parent>/dispatch-<time>-<random>
+const dispatchedJobInfix = "/dispatch-"
+
+// what a dispatched job is building
+type dispatchedBuild struct {
+    CloneURL string
+    Ref      string
+
+    // zero for pushes
+    PullRequest int
+}
+
+// identifies what a dispatched job is building from its push meta or, for jobs
+// dispatched without push meta, from its payload, which nomad stores
+// snappy-compressed.  returns false if neither is one we dispatched.
+func dispatchedBuildOf(job *nomadapi.Job) (dispatchedBuild, bool) {
+    if ref, ok := job.Meta[refMetaKey]; ok {
+        pullRequest, _ := strconv.Atoi(job.Meta[pullRequestMetaKey])
+
+        return dispatchedBuild{
+            CloneURL:    job.Meta[cloneURLMetaKey],
+            Ref:         ref,
+            PullRequest: pullRequest,
+        }, true
+    }
+
+    raw, err := snappy.Decode(nil, job.Payload)
+    if err != nil {
+        raw = job.Payload
+    }
+
+    var versioned struct {
+        SchemaVersion int `json:"schema_version"`
+    }
+
+    if err := json.Unmarshal(raw, &versioned); err != nil {
+        return dispatchedBuild{}, false
+    }
+
+    if versioned.SchemaVersion > 0 {
+        var payload structs.DispatchPayload
+        if err := json.Unmarshal(raw, &payload); err != nil {
+            return dispatchedBuild{}, false
+        }
+
+        build := dispatchedBuild{
+            CloneURL: payload.Repository.CloneURL,
+            Ref:      payload.Ref,
+        }
+
+        if payload.PullRequest != nil {
+            build.PullRequest = payload.PullRequest.Number
+        }
+
+        return build, true
+    }
+
+    // legacy push payloads decode with a zero pull request
+    var payload structs.PullRequestDispatchPayload
+    if err := json.Unmarshal(raw, &payload); err != nil {
+        return dispatchedBuild{}, false
+    }
+
+    return dispatchedBuild{
+        CloneURL:    payload.CloneURL,
+        Ref:         payload.Ref,
+        PullRequest: payload.PullRequest,
+    }, true
+}
+
+// matches jobs building the same repository and ref as pushEvent, whether for
+// a push or a pull request
+func sameRef(pushEvent *forge.PushEvent) func(dispatchedBuild) bool {
+    return func(build dispatchedBuild) bool {
+        return build.CloneURL == pushEvent.CloneURL && build.Ref == pushEvent.Ref
+    }
+}
+
+// matches jobs that a build of pushEvent makes obsolete.  a pull request from a
+// branch in the same repository shares the branch's ref, but neither build
+// supersedes the other.
+func supersededBy(pushEvent *forge.PushEvent) func(dispatchedBuild) bool {
+    var pullRequest int
+    if pushEvent.PullRequest != nil {
+        pullRequest = pushEvent.PullRequest.Number
+    }
+
+    return func(build dispatchedBuild) bool {
+        return sameRef(pushEvent)(build) && build.PullRequest == pullRequest
+    }
+}
+
+// returns the ids of the jobs dispatched from jobId that haven't finished and
+// are building something that matches.  the job list doesn't include meta or
+// payloads, so each candidate has to be retrieved.
+func (self *PushHandler) findDispatchedJobs(cfg *webhookConfig, jobId string, match func(dispatchedBuild) bool) ([]string, error) {
+    stubs, _, err := self.nomad.List(&nomadapi.QueryOptions{
+        Prefix:    jobId + dispatchedJobInfix,
+        Namespace: cfg.Namespace,
+        Region:    cfg.Region,
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    jobIds := []string{}
+    for _, stub := range stubs {
+        if stub.ParentID != jobId || stub.Status == "dead" {
+            continue
+        }
+
+        job, _, err := self.nomad.Info(stub.ID, &nomadapi.QueryOptions{
+            Namespace: cfg.Namespace,
+            Region:    cfg.Region,
+        })
+
+        if err != nil {
+            return nil, err
+        }
+
+        build, ok := dispatchedBuildOf(job)
+        if ok && match(build) {
+            jobIds = append(jobIds, stub.ID)
+        }
+    }
+
+    return jobIds, nil
+}
+
+// stops, without purging, the unfinished jobs dispatched from jobId for
+// pushEvent's ref that match
+func (self *PushHandler) stopDispatchedJobs(logEntry *log.Entry, cfg *webhookConfig, jobId string, pushEvent *forge.PushEvent, match func(dispatchedBuild) bool) error {
+    jobIds, err := self.findDispatchedJobs(cfg, jobId, match)
+    if err != nil {
+        return err
+    }
+
+    for _, dispatchedJobId := range jobIds {
+        evalId, _, err := self.nomad.Deregister(dispatchedJobId, false, &nomadapi.WriteOptions{
+            Namespace: cfg.Namespace,
+            Region:    cfg.Region,
+        })
+
+        if err != nil {
+            return err
+        }
+
+        logEntry.Infof("stopped %s with eval %s for %s", dispatchedJobId, evalId, pushEvent.Ref)
+    }
+
+    return nil
+}
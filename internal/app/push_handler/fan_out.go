@@ -0,0 +1,69 @@
+package push_handler
+
+import (
+    "sort"
+    "strings"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// dispatch meta naming the subproject a fanned-out job was dispatched for
+const subprojectMetaKey = "subproject"
+
+// a job to dispatch for a push event
+type dispatchTarget struct {
+    JobId string
+
+    // the fan-out path prefix, without the trailing "/"; empty when the
+    // token doesn't fan out
+    Subproject string
+}
+
+// returns true if any of the paths are in the directory prefix
+func pathsUnder(paths []string, prefix string) bool {
+    if ! strings.HasSuffix(prefix, "/") {
+        prefix += "/"
+    }
+
+    for _, changed := range paths {
+        if strings.HasPrefix(changed, prefix) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// returns the jobs to dispatch for the push event.  without a fan-out mapping
+// that's the token's dispatch job.  with one, the job for each path prefix
+// containing a changed path is dispatched; paths outside every prefix don't
+// dispatch anything.  if the changed paths aren't known, as for pull requests
+// and deletions, every job in the mapping is returned.
+func (self *webhookConfig) dispatchTargets(pushEvent *forge.PushEvent) []dispatchTarget {
+    if len(self.FanOut) == 0 {
+        return []dispatchTarget{{JobId: self.DispatchJobId}}
+    }
+
+    prefixes := []string{}
+    for prefix := range self.FanOut {
+        prefixes = append(prefixes, prefix)
+    }
+
+    sort.Strings(prefixes)
+
+    paths := changedPaths(pushEvent.Commits)
+
+    targets := []dispatchTarget{}
+    for _, prefix := range prefixes {
+        if paths != nil && ! pathsUnder(paths, prefix) {
+            continue
+        }
+
+        targets = append(targets, dispatchTarget{
+            JobId:      self.FanOut[prefix],
+            Subproject: strings.TrimSuffix(prefix, "/"),
+        })
+    }
+
+    return targets
+}
@@ -0,0 +1,203 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+var _ = Describe("monorepo fan-out", func() {
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph := NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            "clone-some-repo",
+        )
+        ph.EnableReplayProtection(time.Hour)
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "secret":  "s3kr1t",
+                    "fan_out": `{"services/api/": "build-api", "services/web": "build-web", "services/worker/": "build-worker"}`,
+                },
+            }, nil)
+    })
+
+    expectDispatch := func(jobId, subproject string, err error) {
+        var dispatchResp *nomadapi.JobDispatchResponse
+        if err == nil {
+            dispatchResp = &nomadapi.JobDispatchResponse{
+                EvalID: "eval-" + subproject,
+                DispatchedJobID: jobId + "/dispatch-1234",
+            }
+        }
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                jobId,
+                map[string]string{"subproject": subproject},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(dispatchResp, &nomadapi.WriteMeta{}, err)
+    }
+
+    push := func(size, modified string) {
+        payload := fmt.Sprintf(githubRulesPushEventPayload, "refs/heads/master", size, modified)
+
+        req, err := http.NewRequest("POST", "http://example.com/notify/push/github/some-auth-token", strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("s3kr1t", payload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    responseBody := func() map[string]interface{} {
+        Expect(resp.Header().Get("Content-Type")).To(Equal("application/json"))
+
+        var body map[string]interface{}
+        Expect(json.Unmarshal(resp.Body.Bytes(), &body)).ShouldNot(HaveOccurred())
+
+        return body
+    }
+
+    It("should dispatch a job for each changed subproject", func() {
+        expectDispatch("build-api", "services/api", nil)
+        expectDispatch("build-web", "services/web", nil)
+
+        push("", `["services/api/main.go", "services/web/index.html", "README.md"]`)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 2)
+
+        Expect(responseBody()).To(Equal(map[string]interface{}{
+            "dispatched": []interface{}{
+                map[string]interface{}{
+                    "ref":               "refs/heads/master",
+                    "job_id":            "build-api",
+                    "subproject":        "services/api",
+                    "dispatched_job_id": "build-api/dispatch-1234",
+                    "eval_id":           "eval-services/api",
+                },
+                map[string]interface{}{
+                    "ref":               "refs/heads/master",
+                    "job_id":            "build-web",
+                    "subproject":        "services/web",
+                    "dispatched_job_id": "build-web/dispatch-1234",
+                    "eval_id":           "eval-services/web",
+                },
+            },
+        }))
+    })
+
+    It("should not dispatch when no subproject changed", func() {
+        push("", `["README.md", "services/website/index.html"]`)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should dispatch every subproject when the changed paths aren't known", func() {
+        expectDispatch("build-api", "services/api", nil)
+        expectDispatch("build-web", "services/web", nil)
+        expectDispatch("build-worker", "services/worker", nil)
+
+        push(`"size":25,`, `["README.md"]`)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 3)
+    })
+
+    It("should attempt every dispatch and return 503 if any fail", func() {
+        expectDispatch("build-api", "services/api", fmt.Errorf("nomad is down"))
+        expectDispatch("build-web", "services/web", nil)
+
+        push("", `["services/api/main.go", "services/web/index.html"]`)
+        Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 2)
+
+        body := responseBody()
+        Expect(body["dispatched"]).To(HaveLen(1))
+        Expect(body["failed"]).To(Equal([]interface{}{
+            map[string]interface{}{
+                "ref":        "refs/heads/master",
+                "job_id":     "build-api",
+                "subproject": "services/api",
+                "error":      "nomad is down",
+            },
+        }))
+    })
+
+    It("should only retry the dispatches that failed", func() {
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                "build-api",
+                map[string]string{"subproject": "services/api"},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(nil, &nomadapi.WriteMeta{}, fmt.Errorf("nomad is down")).
+            Once()
+        expectDispatch("build-api", "services/api", nil)
+        expectDispatch("build-web", "services/web", nil)
+
+        push("", `["services/api/main.go", "services/web/index.html"]`)
+        Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+
+        resp = httptest.NewRecorder()
+        push("", `["services/api/main.go", "services/web/index.html"]`)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        // api twice, web once
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 3)
+
+        // the earlier dispatch is still reported
+        Expect(responseBody()["dispatched"]).To(HaveLen(2))
+
+        // and once everything is dispatched, it's a redelivery
+        resp = httptest.NewRecorder()
+        push("", `["services/api/main.go", "services/web/index.html"]`)
+        Expect(resp.Code).To(Equal(http.StatusOK))
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 3)
+    })
+})
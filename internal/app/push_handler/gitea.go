@@ -0,0 +1,96 @@
+package push_handler
+
+import (
+    "net/http"
+
+    "crypto/sha256"
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+type giteaProvider struct {}
+
+// https://docs.gitea.com/usage/webhooks#event-information
+// the payload is modeled on github's, but isn't close enough to reuse
+// github.PushEvent.
+type giteaPushEvent struct {
+    Ref    string `json:"ref"`
+    Before string `json:"before"`
+    After  string `json:"after"`
+
+    // commits is limited by the server's webhook settings
+    Commits      []gitCommit `json:"commits"`
+    TotalCommits int         `json:"total_commits"`
+
+    Pusher struct {
+        Login string `json:"login"`
+    } `json:"pusher"`
+
+    Repository struct {
+        FullName string `json:"full_name"`
+        CloneURL string `json:"clone_url"`
+        SSHURL   string `json:"ssh_url"`
+    } `json:"repository"`
+}
+
+// gitea signs the payload with the secret configured on the hook; the
+// signature is the bare hex digest, with no "sha256=" prefix.
+// https://docs.gitea.com/usage/webhooks#authorization-header
+func (self *giteaProvider) Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    hmacSecrets, err := webhookSecretsForRequest(secret)
+    if err != nil {
+        return err
+    }
+
+    var giteaSignature string
+    if xgs, ok := req.Header["X-Gitea-Signature"]; ok {
+        giteaSignature = xgs[0]
+    } else {
+        return newPreflightError("no X-Gitea-Signature header", http.StatusBadRequest)
+    }
+
+    return checkSignature(sha256.New, body, hmacSecrets, "", giteaSignature)
+}
+
+// forgejo sends the X-Gitea-* headers alongside its own
+func (self *giteaProvider) EventType(req *http.Request, body []byte) forge.EventType {
+    if req.Header.Get("X-Gitea-Event") == "push" {
+        return forge.EventPush
+    }
+
+    return forge.EventUnsupported
+}
+
+func (self *giteaProvider) DeliveryID(req *http.Request, body []byte) string {
+    return req.Header.Get("X-Gitea-Delivery")
+}
+
+func (self *giteaProvider) Normalize(eventType forge.EventType, body []byte) ([]*forge.PushEvent, error) {
+    var payload giteaPushEvent
+    err := json.Unmarshal(body, &payload)
+    if err != nil {
+        return nil, err
+    }
+
+    commits := normalizeGitCommits(payload.Commits, payload.TotalCommits)
+
+    return []*forge.PushEvent{
+        {
+            RepoFullName: payload.Repository.FullName,
+            Pusher:       payload.Pusher.Login,
+
+            CloneURL: payload.Repository.CloneURL,
+            SSHURL:   payload.Repository.SSHURL,
+            Ref:      payload.Ref,
+            Before:   payload.Before,
+            After:    payload.After,
+            Deleted:  isZeroSHA(payload.After),
+            Commits:  commits,
+
+            HeadCommit: findCommit(commits, payload.After),
+        },
+    }, nil
+}
@@ -0,0 +1,113 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+// trimmed from the example in the Gitea webhook docs
+var giteaPushEventExamplePayload string = `{"secret":"","ref":"refs/heads/develop","before":"28e1879d029cb852e4844d9c718537df08844e03","after":"bffeb74224043ba2feb48d137756c8a9331c449a","compare_url":"http://localhost:3000/gitea/webhooks/compare/28e1879d029cb852e4844d9c718537df08844e03...bffeb74224043ba2feb48d137756c8a9331c449a","commits":[{"id":"bffeb74224043ba2feb48d137756c8a9331c449a","message":"Webhooks Yay!","url":"http://localhost:3000/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a","author":{"name":"Gitea","email":"someone@gitea.io","username":"gitea"},"committer":{"name":"Gitea","email":"someone@gitea.io","username":"gitea"},"timestamp":"2017-03-13T13:52:11-04:00","added":[],"removed":[],"modified":["README.md"]}],"repository":{"id":140,"owner":{"id":1,"login":"gitea","full_name":"Gitea","email":"someone@gitea.io","avatar_url":"https://localhost:3000/avatars/1","username":"gitea"},"name":"webhooks","full_name":"gitea/webhooks","description":"","private":false,"fork":false,"html_url":"http://localhost:3000/gitea/webhooks","ssh_url":"ssh://gitea@localhost:2222/gitea/webhooks.git","clone_url":"http://localhost:3000/gitea/webhooks.git","website":"","stars_count":0,"forks_count":1,"watchers_count":1,"open_issues_count":7,"default_branch":"master","created_at":"2017-02-26T04:29:06-05:00","updated_at":"2017-03-13T13:51:58-04:00"},"pusher":{"id":1,"login":"gitea","full_name":"Gitea","email":"someone@gitea.io","avatar_url":"https://localhost:3000/avatars/1","username":"gitea"},"sender":{"id":1,"login":"gitea","full_name":"Gitea","email":"someone@gitea.io","avatar_url":"https://localhost:3000/avatars/1","username":"gitea"}}`
+
+var _ = Describe("PushHandler for Gitea", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+    endpoint := "http://example.com/notify/push/gitea/some-auth-token"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/gitea/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "secret": "s3kr1t",
+                },
+            }, nil)
+    })
+
+    newRequest := func(signature string) *http.Request {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(giteaPushEventExamplePayload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Gitea-Event", "push")
+        req.Header.Add("X-Gitea-Delivery", "some-uuid")
+        req.Header.Add("X-Gitea-Signature", signature)
+
+        return req
+    }
+
+    It("should handle a push event", func() {
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+
+        router.ServeHTTP(resp, newRequest(hexMacSHA256("s3kr1t", giteaPushEventExamplePayload)))
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockVaultLogical.AssertExpectations(GinkgoT())
+        mockNomadJobs.AssertExpectations(GinkgoT())
+
+        var dispatchPayload structs.CloneDispatchPayload
+        Expect(json.Unmarshal(mockNomadJobs.Calls[0].Arguments[2].([]byte), &dispatchPayload)).ShouldNot(HaveOccurred())
+
+        Expect(dispatchPayload).To(Equal(structs.CloneDispatchPayload{
+            CloneURL: "http://localhost:3000/gitea/webhooks.git",
+            Ref:      "refs/heads/develop",
+            SHA:      "bffeb74224043ba2feb48d137756c8a9331c449a",
+        }))
+    })
+
+    It("should return 403 for an invalid signature", func() {
+        router.ServeHTTP(resp, newRequest(hexMacSHA256("wrong", giteaPushEventExamplePayload)))
+        Expect(resp.Code).To(Equal(http.StatusForbidden))
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+})
@@ -0,0 +1,190 @@
+package push_handler
+
+import (
+    "fmt"
+    "net/http"
+
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/google/go-github/github"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+type gitHubProvider struct {}
+
+// https://docs.github.com/en/webhooks/using-webhooks/validating-webhook-deliveries
+// github sends both X-Hub-Signature-256 and the legacy sha1 X-Hub-Signature.
+// sha1 is only accepted if the Vault secret sets "allow_sha1", for senders
+// that can't produce sha256 signatures.
+func (self *gitHubProvider) Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    hmacSecrets, err := webhookSecretsForRequest(secret)
+    if err != nil {
+        return err
+    }
+
+    if xhs, ok := req.Header["X-Hub-Signature-256"]; ok {
+        return checkSignature(sha256.New, body, hmacSecrets, "sha256=", xhs[0])
+    }
+
+    if ! secretFlag(secret, "allow_sha1") {
+        return newPreflightError("no X-Hub-Signature-256 header", http.StatusBadRequest)
+    }
+
+    if xhs, ok := req.Header["X-Hub-Signature"]; ok {
+        return checkSignature(sha1.New, body, hmacSecrets, "sha1=", xhs[0])
+    }
+
+    return newPreflightError("no X-Hub-Signature-256 or X-Hub-Signature header", http.StatusBadRequest)
+}
+
+func (self *gitHubProvider) EventType(req *http.Request, body []byte) forge.EventType {
+    switch req.Header.Get("X-Github-Event") {
+        case "push":
+            return forge.EventPush
+
+        case "ping":
+            return forge.EventPing
+
+        case "pull_request":
+            return forge.EventPullRequest
+    }
+
+    return forge.EventUnsupported
+}
+
+func (self *gitHubProvider) DeliveryID(req *http.Request, body []byte) string {
+    return req.Header.Get("X-Github-Delivery")
+}
+
+func (self *gitHubProvider) Normalize(eventType forge.EventType, body []byte) ([]*forge.PushEvent, error) {
+    switch eventType {
+        case forge.EventPush:
+            return normalizeGitHubPushEvent(body)
+
+        case forge.EventPing:
+            return nil, validateGitHubPingEvent(body)
+
+        case forge.EventPullRequest:
+            return normalizeGitHubPullRequestEvent(body)
+    }
+
+    return nil, nil
+}
+
+// https://developer.github.com/v3/activity/events/types/#pushevent
+func normalizeGitHubPushEvent(body []byte) ([]*forge.PushEvent, error) {
+    var payload github.PushEvent
+    err := json.Unmarshal(body, &payload)
+    if err != nil {
+        return nil, err
+    }
+
+    // size is only sent when the commit list may have been truncated
+    var commits []*forge.Commit
+    if payload.Size == nil || payload.GetSize() <= len(payload.Commits) {
+        commits = []*forge.Commit{}
+
+        for _, commit := range payload.Commits {
+            commits = append(commits, &forge.Commit{
+                ID:       commit.GetID(),
+                Message:  commit.GetMessage(),
+                Added:    commit.Added,
+                Modified: commit.Modified,
+                Removed:  commit.Removed,
+            })
+        }
+    }
+
+    var headCommit *forge.Commit
+    if payload.HeadCommit != nil {
+        headCommit = &forge.Commit{
+            ID:       payload.HeadCommit.GetID(),
+            Message:  payload.HeadCommit.GetMessage(),
+            Added:    payload.HeadCommit.Added,
+            Modified: payload.HeadCommit.Modified,
+            Removed:  payload.HeadCommit.Removed,
+        }
+    }
+
+    return []*forge.PushEvent{
+        {
+            RepoFullName: payload.Repo.GetFullName(),
+            Pusher:       payload.Pusher.GetName(),
+
+            CloneURL: payload.Repo.GetCloneURL(),
+            SSHURL:   payload.Repo.GetSSHURL(),
+            GitURL:   payload.Repo.GetGitURL(),
+            Ref:      payload.GetRef(),
+            Before:   payload.GetBefore(),
+            After:    payload.GetAfter(),
+            Deleted:  payload.GetDeleted() || isZeroSHA(payload.GetAfter()),
+            Commits:  commits,
+
+            HeadCommit: headCommit,
+        },
+    }, nil
+}
+
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads#pull_request
+// only actions that change the code to build are dispatched; others, like
+// labeling or closing, are acknowledged without a build.
+func normalizeGitHubPullRequestEvent(body []byte) ([]*forge.PushEvent, error) {
+    var payload github.PullRequestEvent
+    err := json.Unmarshal(body, &payload)
+    if err != nil {
+        return nil, err
+    }
+
+    switch payload.GetAction() {
+        case "opened", "synchronize", "reopened":
+            // build it
+
+        default:
+            return nil, nil
+    }
+
+    pr := payload.PullRequest
+    if pr == nil || pr.Head == nil || pr.Base == nil {
+        return nil, fmt.Errorf("pull request is missing head or base")
+    }
+
+    // there's nothing to clone once the fork behind a pull request is deleted
+    if pr.Head.Repo == nil || pr.Base.Repo == nil {
+        return nil, fmt.Errorf("pull request %d is missing its head or base repository", pr.GetNumber())
+    }
+
+    return []*forge.PushEvent{
+        {
+            RepoFullName: payload.Repo.GetFullName(),
+            Pusher:       payload.Sender.GetLogin(),
+
+            // the head repo is the fork, if the pull request is from one
+            CloneURL: pr.Head.Repo.GetCloneURL(),
+            SSHURL:   pr.Head.Repo.GetSSHURL(),
+            GitURL:   pr.Head.Repo.GetGitURL(),
+            Ref:      "refs/heads/" + pr.Head.GetRef(),
+            After:    pr.Head.GetSHA(),
+
+            PullRequest: &forge.PullRequest{
+                Number:       pr.GetNumber(),
+                BaseRef:      "refs/heads/" + pr.Base.GetRef(),
+                BaseCloneURL: pr.Base.Repo.GetCloneURL(),
+                BaseSSHURL:   pr.Base.Repo.GetSSHURL(),
+                BaseGitURL:   pr.Base.Repo.GetGitURL(),
+                MergeRef:     fmt.Sprintf("refs/pull/%d/merge", pr.GetNumber()),
+            },
+        },
+    }, nil
+}
+
+// https://developer.github.com/webhooks/#ping-event
+// there's nothing to dispatch, but the payload should still be well-formed.
+func validateGitHubPingEvent(body []byte) error {
+    var payload github.PingEvent
+    return json.Unmarshal(body, &payload)
+}
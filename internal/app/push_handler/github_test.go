@@ -0,0 +1,140 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+// trimmed from the example in the GitHub docs; a pull request from a fork
+var githubPullRequestEventExamplePayload string = `{"action":"%s","number":2,"pull_request":{"url":"https://api.github.com/repos/Codertocat/Hello-World/pulls/2","id":279147437,"number":2,"state":"open","locked":false,"title":"Update the README with new information.","user":{"login":"Codertocat","id":21031067},"body":"This is a pretty simple change that we need to pull into master.","head":{"label":"forker:changes","ref":"changes","sha":"ec26c3e57ca3a959ca5aad62de7213c562f8c821","user":{"login":"forker","id":21031068},"repo":{"id":186853003,"name":"Hello-World","full_name":"forker/Hello-World","clone_url":"https://github.com/forker/Hello-World.git","ssh_url":"git@github.com:forker/Hello-World.git"}},"base":{"label":"Codertocat:master","ref":"master","sha":"f95f852bd8fca8fcc58a9a2d6c842781e32a215e","user":{"login":"Codertocat","id":21031067},"repo":{"id":186853002,"name":"Hello-World","full_name":"Codertocat/Hello-World","clone_url":"https://github.com/Codertocat/Hello-World.git","ssh_url":"git@github.com:Codertocat/Hello-World.git"}}},"repository":{"id":186853002,"name":"Hello-World","full_name":"Codertocat/Hello-World","clone_url":"https://github.com/Codertocat/Hello-World.git"},"sender":{"login":"Codertocat","id":21031067}}`
+
+var _ = Describe("PushHandler for GitHub pull requests", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+    endpoint := "http://example.com/notify/push/github/some-auth-token"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "secret": "s3kr1t",
+                },
+            }, nil)
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    sendPayload := func(payload string) {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "pull_request")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("s3kr1t", payload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    pullRequest := func(action string) {
+        sendPayload(strings.Replace(githubPullRequestEventExamplePayload, "%s", action, 1))
+    }
+
+    for _, action := range []string{"opened", "synchronize", "reopened"} {
+        action := action
+
+        It("should dispatch the head of the pull request when " + action, func() {
+            pullRequest(action)
+            Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+            mockNomadJobs.AssertExpectations(GinkgoT())
+
+            var dispatchPayload structs.PullRequestDispatchPayload
+            Expect(json.Unmarshal(mockNomadJobs.Calls[0].Arguments[2].([]byte), &dispatchPayload)).ShouldNot(HaveOccurred())
+
+            Expect(dispatchPayload).To(Equal(structs.PullRequestDispatchPayload{
+                CloneDispatchPayload: structs.CloneDispatchPayload{
+                    CloneURL: "https://github.com/forker/Hello-World.git",
+                    Ref:      "refs/heads/changes",
+                    SHA:      "ec26c3e57ca3a959ca5aad62de7213c562f8c821",
+                },
+
+                PullRequest:  2,
+                BaseRef:      "refs/heads/master",
+                BaseCloneURL: "https://github.com/Codertocat/Hello-World.git",
+                MergeRef:     "refs/pull/2/merge",
+            }))
+        })
+    }
+
+    It("should not dispatch other actions", func() {
+        pullRequest("closed")
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should not dispatch a pull request whose fork was deleted", func() {
+        // github sends a null head repo once the fork is gone
+        payload := strings.Replace(githubPullRequestEventExamplePayload, "%s", "synchronize", 1)
+        payload = strings.Replace(payload, `"repo":{"id":186853003,"name":"Hello-World","full_name":"forker/Hello-World","clone_url":"https://github.com/forker/Hello-World.git","ssh_url":"git@github.com:forker/Hello-World.git"}`, `"repo":null`, 1)
+        Expect(payload).To(ContainSubstring(`"repo":null`))
+
+        sendPayload(payload)
+        Expect(resp.Code).To(Equal(http.StatusBadRequest))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+})
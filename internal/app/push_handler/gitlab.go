@@ -0,0 +1,141 @@
+package push_handler
+
+import (
+    "net/http"
+
+    "crypto/subtle"
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+type gitLabProvider struct {}
+
+// https://docs.gitlab.com/ee/user/project/integrations/webhooks.html#push-events
+// only the fields we need are unmarshalled; the tag push payload has the same
+// shape.
+type gitLabPushEvent struct {
+    ObjectKind  string `json:"object_kind"`
+    Ref         string `json:"ref"`
+    Before      string `json:"before"`
+    After       string `json:"after"`
+    CheckoutSHA string `json:"checkout_sha"`
+
+    UserUsername string `json:"user_username"`
+
+    // commits is limited to 20 entries
+    Commits           []gitCommit `json:"commits"`
+    TotalCommitsCount int         `json:"total_commits_count"`
+
+    Project struct {
+        PathWithNamespace string `json:"path_with_namespace"`
+        GitHTTPURL        string `json:"git_http_url"`
+        GitSSHURL         string `json:"git_ssh_url"`
+    } `json:"project"`
+}
+
+// the commit entries in gitlab and gitea push payloads
+type gitCommit struct {
+    ID       string   `json:"id"`
+    Message  string   `json:"message"`
+    Added    []string `json:"added"`
+    Modified []string `json:"modified"`
+    Removed  []string `json:"removed"`
+}
+
+// converts the commits in a push payload.  returns nil if the payload says
+// there were more commits than it included.
+func normalizeGitCommits(gitCommits []gitCommit, totalCount int) []*forge.Commit {
+    if totalCount > len(gitCommits) {
+        return nil
+    }
+
+    commits := []*forge.Commit{}
+    for _, commit := range gitCommits {
+        commits = append(commits, &forge.Commit{
+            ID:       commit.ID,
+            Message:  commit.Message,
+            Added:    commit.Added,
+            Modified: commit.Modified,
+            Removed:  commit.Removed,
+        })
+    }
+
+    return commits
+}
+
+// gitlab sends the secret token configured for the hook verbatim in the
+// X-Gitlab-Token header.
+// https://docs.gitlab.com/ee/user/project/integrations/webhooks.html#secret-token
+func (self *gitLabProvider) Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    expectedTokens, err := webhookSecretsForRequest(secret)
+    if err != nil {
+        return err
+    }
+
+    var gitlabToken string
+    if xgt, ok := req.Header["X-Gitlab-Token"]; ok {
+        gitlabToken = xgt[0]
+    } else {
+        return newPreflightError("no X-Gitlab-Token header", http.StatusBadRequest)
+    }
+
+    for _, expectedToken := range expectedTokens {
+        if subtle.ConstantTimeCompare([]byte(gitlabToken), []byte(expectedToken)) == 1 {
+            return nil
+        }
+    }
+
+    return newPreflightError("bad webhook token", http.StatusForbidden)
+}
+
+// tag pushes are dispatched the same as branch pushes
+func (self *gitLabProvider) EventType(req *http.Request, body []byte) forge.EventType {
+    switch req.Header.Get("X-Gitlab-Event") {
+        case "Push Hook", "Tag Push Hook":
+            return forge.EventPush
+    }
+
+    return forge.EventUnsupported
+}
+
+// gitlab sends the same Idempotency-Key when a delivery is retried or resent
+func (self *gitLabProvider) DeliveryID(req *http.Request, body []byte) string {
+    return req.Header.Get("Idempotency-Key")
+}
+
+func (self *gitLabProvider) Normalize(eventType forge.EventType, body []byte) ([]*forge.PushEvent, error) {
+    var payload gitLabPushEvent
+    err := json.Unmarshal(body, &payload)
+    if err != nil {
+        return nil, err
+    }
+
+    // for annotated tags "after" is the sha of the tag object; checkout_sha is
+    // always the commit.
+    sha := payload.CheckoutSHA
+    if sha == "" {
+        sha = payload.After
+    }
+
+    commits := normalizeGitCommits(payload.Commits, payload.TotalCommitsCount)
+
+    return []*forge.PushEvent{
+        {
+            RepoFullName: payload.Project.PathWithNamespace,
+            Pusher:       payload.UserUsername,
+
+            CloneURL: payload.Project.GitHTTPURL,
+            SSHURL:   payload.Project.GitSSHURL,
+            Ref:      payload.Ref,
+            Before:   payload.Before,
+            After:    sha,
+            Deleted:  isZeroSHA(payload.After),
+            Commits:  commits,
+
+            HeadCommit: findCommit(commits, sha),
+        },
+    }, nil
+}
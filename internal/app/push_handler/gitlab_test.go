@@ -0,0 +1,142 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+// trimmed from the examples in the GitLab webhook docs
+var gitlabPushEventExamplePayload string = `{"object_kind":"push","event_name":"push","before":"95790bf891e76fee5e1747ab589903a6a1f80f22","after":"da1560886d4f094c3e6c9ef40349f7d38b5d27d7","ref":"refs/heads/master","checkout_sha":"da1560886d4f094c3e6c9ef40349f7d38b5d27d7","user_id":4,"user_name":"John Smith","user_username":"jsmith","user_email":"john@example.com","project_id":15,"project":{"id":15,"name":"Diaspora","description":"","web_url":"http://example.com/mike/diaspora","git_ssh_url":"git@example.com:mike/diaspora.git","git_http_url":"http://example.com/mike/diaspora.git","namespace":"Mike","visibility_level":0,"path_with_namespace":"mike/diaspora","default_branch":"master"},"commits":[{"id":"da1560886d4f094c3e6c9ef40349f7d38b5d27d7","message":"fixed readme","timestamp":"2012-01-03T23:36:29+02:00","url":"http://example.com/mike/diaspora/commit/da1560886d4f094c3e6c9ef40349f7d38b5d27d7","author":{"name":"GitLab dev user","email":"gitlabdev@dv6700.(none)"},"added":["CHANGELOG"],"modified":["app/controller/application.rb"],"removed":[]}],"total_commits_count":1}`
+var gitlabTagPushEventExamplePayload string = `{"object_kind":"tag_push","event_name":"tag_push","before":"0000000000000000000000000000000000000000","after":"82b3d5ae55f7080f1e6022629cdb57bfae7cccc7","ref":"refs/tags/v1.0.0","checkout_sha":"5937ac0a7beb003549fc5fd26fc247adbce4a52e","user_id":1,"user_name":"John Smith","user_username":"jsmith","project_id":1,"project":{"id":1,"name":"Example","web_url":"http://example.com/jsmith/example","git_ssh_url":"git@example.com:jsmith/example.git","git_http_url":"http://example.com/jsmith/example.git","namespace":"Jsmith","path_with_namespace":"jsmith/example","default_branch":"master"},"commits":[],"total_commits_count":0}`
+
+var _ = Describe("PushHandler for GitLab", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+    endpoint := "http://example.com/notify/push/gitlab/some-auth-token"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/gitlab/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "secret": "s3kr1t",
+                },
+            }, nil)
+    })
+
+    newRequest := func(event, payload, token string) *http.Request {
+        req, err := http.NewRequest("POST", endpoint, strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Gitlab-Event", event)
+        if token != "" {
+            req.Header.Add("X-Gitlab-Token", token)
+        }
+
+        return req
+    }
+
+    expectDispatch := func() {
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    }
+
+    dispatchedPayload := func() structs.CloneDispatchPayload {
+        var dispatchPayload structs.CloneDispatchPayload
+        Expect(json.Unmarshal(mockNomadJobs.Calls[0].Arguments[2].([]byte), &dispatchPayload)).ShouldNot(HaveOccurred())
+
+        return dispatchPayload
+    }
+
+    It("should handle a push event", func() {
+        expectDispatch()
+
+        router.ServeHTTP(resp, newRequest("Push Hook", gitlabPushEventExamplePayload, "s3kr1t"))
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockVaultLogical.AssertExpectations(GinkgoT())
+        mockNomadJobs.AssertExpectations(GinkgoT())
+
+        Expect(dispatchedPayload()).To(Equal(structs.CloneDispatchPayload{
+            CloneURL: "http://example.com/mike/diaspora.git",
+            Ref:      "refs/heads/master",
+            SHA:      "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+        }))
+    })
+
+    It("should dispatch the commit for a tag push event", func() {
+        expectDispatch()
+
+        router.ServeHTTP(resp, newRequest("Tag Push Hook", gitlabTagPushEventExamplePayload, "s3kr1t"))
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        Expect(dispatchedPayload()).To(Equal(structs.CloneDispatchPayload{
+            CloneURL: "http://example.com/jsmith/example.git",
+            Ref:      "refs/tags/v1.0.0",
+            SHA:      "5937ac0a7beb003549fc5fd26fc247adbce4a52e",
+        }))
+    })
+
+    It("should return 403 for an invalid token", func() {
+        router.ServeHTTP(resp, newRequest("Push Hook", gitlabPushEventExamplePayload, "not-the-secret"))
+        Expect(resp.Code).To(Equal(http.StatusForbidden))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should return 400 without a token", func() {
+        router.ServeHTTP(resp, newRequest("Push Hook", gitlabPushEventExamplePayload, ""))
+        Expect(resp.Code).To(Equal(http.StatusBadRequest))
+    })
+})
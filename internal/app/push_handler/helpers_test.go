@@ -0,0 +1,39 @@
+package push_handler_test
+
+import (
+    . "github.com/onsi/gomega"
+
+    "hash"
+
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+
+    "github.com/golang/snappy"
+
+    nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// hex-encoded hmac of payload, for providers that sign their deliveries
+func hexMac(hashFunc func() hash.Hash, secret, payload string) string {
+    mac := hmac.New(hashFunc, []byte(secret))
+    mac.Write([]byte(payload))
+
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hexMacSHA256(secret, payload string) string {
+    return hexMac(sha256.New, secret, payload)
+}
+
+// a job dispatched by a previous delivery, with the payload compressed the way
+// nomad stores it
+func dispatchedJob(payload interface{}) *nomadapi.Job {
+    payloadBytes, err := json.Marshal(payload)
+    Expect(err).ShouldNot(HaveOccurred())
+
+    return &nomadapi.Job{
+        Payload: snappy.Encode(nil, payloadBytes),
+    }
+}
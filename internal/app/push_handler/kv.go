@@ -0,0 +1,185 @@
+package push_handler
+
+import (
+    "fmt"
+    "path"
+    "strconv"
+    "strings"
+
+    "net/http"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+// returns the mount path, like "secret/", and KV secrets engine version of the
+// mount containing prefix.  Vault reports this to any token that can access
+// the path.
+func DetectKVMount(vault interfaces.VaultLogical, prefix string) (string, int, error) {
+    secret, err := vault.Read(path.Join("sys/internal/ui/mounts", prefix))
+    if err != nil {
+        return "", 0, err
+    }
+
+    if secret == nil {
+        return "", 0, fmt.Errorf("no mount found for %s", prefix)
+    }
+
+    mount, _ := secret.Data["path"].(string)
+    if mount == "" {
+        return "", 0, fmt.Errorf("no mount path for %s", prefix)
+    }
+
+    if mountType, _ := secret.Data["type"].(string); mountType != "kv" && mountType != "generic" {
+        return "", 0, fmt.Errorf("%s is a %s mount, not kv", mount, mountType)
+    }
+
+    // kv v1 mounts may not have a version option at all
+    version := 1
+    if options, ok := secret.Data["options"].(map[string]interface{}); ok {
+        if str, ok := options["version"].(string); ok && str != "" {
+            if version, err = strconv.Atoi(str); err != nil {
+                return "", 0, fmt.Errorf("unknown kv version %q for %s", str, mount)
+            }
+        }
+    }
+
+    return mount, version, nil
+}
+
+// reads webhook secrets from a KV v2 secrets engine mounted at mount, which
+// must contain the token prefix
+func (self *PushHandler) UseKVv2(mount string) error {
+    mount = strings.Trim(mount, "/") + "/"
+
+    if ! strings.HasPrefix(strings.Trim(self.webhookTokenPrefix, "/") + "/", mount) {
+        return fmt.Errorf("webhook token prefix %s is not in %s", self.webhookTokenPrefix, mount)
+    }
+
+    self.kvMount = mount
+
+    return nil
+}
+
+// the Vault path of a webhook's secret.  for KV v2 that's under the mount's
+// data/ path.
+func (self *PushHandler) webhookSecretPath(providerName, authToken string) string {
+    secretPath := path.Join(self.webhookTokenPrefix, providerName, authToken)
+    if self.kvMount == "" {
+        return secretPath
+    }
+
+    relative := strings.TrimPrefix(strings.Trim(secretPath, "/"), self.kvMount)
+
+    return path.Join(self.kvMount, "data", relative)
+}
+
+// maps a path as `vault kv` takes it, at or under the webhook token prefix, to
+// the path its secret is read from, so it can be used to invalidate cached
+// secrets.  a trailing slash is kept, and other paths are returned unchanged.
+func (self *PushHandler) SecretPath(logicalPath string) string {
+    prefix := strings.Trim(self.webhookTokenPrefix, "/")
+    trimmed := strings.TrimLeft(logicalPath, "/")
+
+    if self.kvMount == "" || (trimmed != prefix && ! strings.HasPrefix(trimmed, prefix + "/")) {
+        return logicalPath
+    }
+
+    relative := strings.TrimPrefix(strings.TrimPrefix(trimmed, strings.TrimSuffix(self.kvMount, "/")), "/")
+
+    return self.kvMount + "data/" + relative
+}
+
+// the version a KV v2 secret's "pinned_version" custom metadata asks for, if
+// it isn't the version that was read; 0 otherwise.  versions are numbered per
+// secret, so each token's secret is pinned separately.
+func pinnedVersion(secret *vaultapi.Secret) (int, error) {
+    metadata, _ := secret.Data["metadata"].(map[string]interface{})
+    customMetadata, _ := metadata["custom_metadata"].(map[string]interface{})
+
+    pinned, _ := customMetadata["pinned_version"].(string)
+    if pinned == "" || pinned == fmt.Sprint(metadata["version"]) {
+        return 0, nil
+    }
+
+    version, err := strconv.Atoi(pinned)
+    if err != nil || version < 1 {
+        return 0, fmt.Errorf("invalid pinned_version %q", pinned)
+    }
+
+    return version, nil
+}
+
+// reads a webhook's secret from Vault, returning a preflight error for a 503
+// when Vault can't be read
+func (self *PushHandler) readVault(read func() (*vaultapi.Secret, error)) (*vaultapi.Secret, *preflightError) {
+    secret, err := read()
+
+    // an error means Vault is unreachable or refused us, not that the token is
+    // unknown, so the delivery should be retried rather than rejected
+    if err != nil {
+        preflightErr := newPreflightError(fmt.Sprintf("unable to read webhook secret: %s", err), http.StatusServiceUnavailable)
+        preflightErr.retryAfter = vaultRetryAfter
+
+        return nil, preflightErr
+    }
+
+    return secret, nil
+}
+
+// reads a webhook's secret from Vault.  KV v2 secrets are unwrapped so they
+// look like KV v1 secrets, after reading the pinned version if there is one; a
+// deleted or destroyed version is treated as missing.
+func (self *PushHandler) readWebhookSecret(providerName, authToken string) (*vaultapi.Secret, *preflightError) {
+    secretPath := self.webhookSecretPath(providerName, authToken)
+
+    secret, preflightErr := self.readVault(func() (*vaultapi.Secret, error) {
+        return self.vault.Read(secretPath)
+    })
+
+    if preflightErr != nil || secret == nil || self.kvMount == "" {
+        return secret, preflightErr
+    }
+
+    version, err := pinnedVersion(secret)
+    if err != nil {
+        return nil, newPreflightError(fmt.Sprintf("malformed webhook secret: %s", err), http.StatusInternalServerError)
+    }
+
+    if version > 0 {
+        vault, ok := self.vault.(interfaces.VaultLogicalWithData)
+        if ! ok {
+            return nil, newPreflightError(fmt.Sprintf("the Vault client can't read pinned version %d", version), http.StatusInternalServerError)
+        }
+
+        secret, preflightErr = self.readVault(func() (*vaultapi.Secret, error) {
+            return vault.ReadWithData(secretPath, map[string][]string{
+                "version": {strconv.Itoa(version)},
+            })
+        })
+
+        if preflightErr != nil || secret == nil {
+            return nil, preflightErr
+        }
+    }
+
+    val, ok := secret.Data["data"]
+    if ! ok || val == nil {
+        return nil, nil
+    }
+
+    data, ok := val.(map[string]interface{})
+    if ! ok {
+        return nil, newPreflightError(fmt.Sprintf("malformed webhook secret: data is a %T, not a map", val), http.StatusInternalServerError)
+    }
+
+    if data == nil {
+        return nil, nil
+    }
+
+    unwrapped := *secret
+    unwrapped.Data = data
+
+    return &unwrapped, nil
+}
@@ -0,0 +1,258 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "fmt"
+
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+var _ = Describe("KV v2 webhook secrets", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+
+    var mockVaultLogical interfaces.MockVaultLogicalWithData
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    kvv2Secret := func(data map[string]interface{}) *vaultapi.Secret {
+        return &vaultapi.Secret{
+            Data: map[string]interface{}{
+                "data": data,
+                "metadata": map[string]interface{}{
+                    "version": "3",
+                },
+            },
+        }
+    }
+
+    pinnedSecret := func(data map[string]interface{}, pinned string) *vaultapi.Secret {
+        secret := kvv2Secret(data)
+        secret.Data["metadata"].(map[string]interface{})["custom_metadata"] = map[string]interface{}{
+            "pinned_version": pinned,
+        }
+
+        return secret
+    }
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogicalWithData{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "secret/webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    push := func() {
+        req, err := http.NewRequest(
+            "POST",
+            "http://example.com/notify/push/github/some-auth-token",
+            strings.NewReader(githubPushEventExamplePayload),
+        )
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
+
+        router.ServeHTTP(resp, req)
+    }
+
+    It("should read and unwrap the secret from the data path", func() {
+        Expect(ph.UseKVv2("secret/")).ShouldNot(HaveOccurred())
+
+        mockVaultLogical.
+            On("Read", "secret/data/webhook-tokens/github/some-auth-token").
+            Return(kvv2Secret(map[string]interface{}{
+                "secret": "011746565c10e8c64df18d8724bc542da584433c",
+            }), nil)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+    })
+
+    It("should read the version the secret is pinned to", func() {
+        Expect(ph.UseKVv2("secret")).ShouldNot(HaveOccurred())
+
+        mockVaultLogical.
+            On("Read", "secret/data/webhook-tokens/github/some-auth-token").
+            Return(pinnedSecret(map[string]interface{}{
+                "secret": "rotated",
+            }, "2"), nil)
+
+        mockVaultLogical.
+            On("ReadWithData", "secret/data/webhook-tokens/github/some-auth-token", map[string][]string{"version": {"2"}}).
+            Return(kvv2Secret(map[string]interface{}{
+                "secret": "011746565c10e8c64df18d8724bc542da584433c",
+            }), nil)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockVaultLogical.AssertExpectations(GinkgoT())
+    })
+
+    It("should not read the pinned version again when it's the latest", func() {
+        Expect(ph.UseKVv2("secret/")).ShouldNot(HaveOccurred())
+
+        mockVaultLogical.
+            On("Read", "secret/data/webhook-tokens/github/some-auth-token").
+            Return(pinnedSecret(map[string]interface{}{
+                "secret": "011746565c10e8c64df18d8724bc542da584433c",
+            }, "3"), nil)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockVaultLogical.AssertNotCalled(GinkgoT(), "ReadWithData", mock.Anything, mock.Anything)
+    })
+
+    It("should return 500 for an invalid pin", func() {
+        Expect(ph.UseKVv2("secret/")).ShouldNot(HaveOccurred())
+
+        mockVaultLogical.
+            On("Read", "secret/data/webhook-tokens/github/some-auth-token").
+            Return(pinnedSecret(map[string]interface{}{
+                "secret": "011746565c10e8c64df18d8724bc542da584433c",
+            }, "latest"), nil)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+    })
+
+    It("should return 404 for a deleted secret", func() {
+        Expect(ph.UseKVv2("secret/")).ShouldNot(HaveOccurred())
+
+        mockVaultLogical.
+            On("Read", "secret/data/webhook-tokens/github/some-auth-token").
+            Return(kvv2Secret(nil), nil)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusNotFound))
+    })
+
+    It("should return 500 for malformed data", func() {
+        Expect(ph.UseKVv2("secret/")).ShouldNot(HaveOccurred())
+
+        mockVaultLogical.
+            On("Read", "secret/data/webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: map[string]interface{}{"data": "011746565c10e8c64df18d8724bc542da584433c"}}, nil)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+    })
+
+    It("should map paths under the prefix to their data paths", func() {
+        Expect(ph.SecretPath("secret/webhook-tokens/github/")).To(Equal("secret/webhook-tokens/github/"))
+
+        Expect(ph.UseKVv2("secret/")).ShouldNot(HaveOccurred())
+
+        Expect(ph.SecretPath("secret/webhook-tokens/github/")).To(Equal("secret/data/webhook-tokens/github/"))
+        Expect(ph.SecretPath("secret/webhook-tokens")).To(Equal("secret/data/webhook-tokens"))
+        Expect(ph.SecretPath("secret/data/webhook-tokens/github/")).To(Equal("secret/data/webhook-tokens/github/"))
+        Expect(ph.SecretPath("secret/other/")).To(Equal("secret/other/"))
+    })
+
+    It("should reject a mount that doesn't contain the prefix", func() {
+        Expect(ph.UseKVv2("kv/")).Should(MatchError(ContainSubstring("not in kv/")))
+    })
+
+    It("should return 500 for a pin the client can't read", func() {
+        vault := interfaces.MockVaultLogical{}
+        vault.
+            On("Read", "secret/data/webhook-tokens/github/some-auth-token").
+            Return(pinnedSecret(map[string]interface{}{
+                "secret": "011746565c10e8c64df18d8724bc542da584433c",
+            }, "2"), nil)
+
+        router = mux.NewRouter()
+        ph = NewPushHandler(&vault, "secret/webhook-tokens", &mockNomadJobs, dispatchJobId)
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+        Expect(ph.UseKVv2("secret/")).ShouldNot(HaveOccurred())
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+    })
+
+    Describe("detecting the mount", func() {
+        It("should detect a KV v2 mount", func() {
+            mockVaultLogical.
+                On("Read", "sys/internal/ui/mounts/secret/webhook-tokens").
+                Return(&vaultapi.Secret{Data: map[string]interface{}{
+                    "path":    "secret/",
+                    "type":    "kv",
+                    "options": map[string]interface{}{"version": "2"},
+                }}, nil)
+
+            mount, version, err := DetectKVMount(&mockVaultLogical, "secret/webhook-tokens")
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(mount).To(Equal("secret/"))
+            Expect(version).To(Equal(2))
+        })
+
+        It("should detect a KV v1 mount without options", func() {
+            mockVaultLogical.
+                On("Read", "sys/internal/ui/mounts/secret/webhook-tokens").
+                Return(&vaultapi.Secret{Data: map[string]interface{}{
+                    "path":    "secret/",
+                    "type":    "kv",
+                    "options": nil,
+                }}, nil)
+
+            _, version, err := DetectKVMount(&mockVaultLogical, "secret/webhook-tokens")
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(version).To(Equal(1))
+        })
+
+        It("should fail when Vault can't be asked", func() {
+            mockVaultLogical.
+                On("Read", "sys/internal/ui/mounts/secret/webhook-tokens").
+                Return(nil, fmt.Errorf("permission denied"))
+
+            _, _, err := DetectKVMount(&mockVaultLogical, "secret/webhook-tokens")
+            Expect(err).Should(MatchError("permission denied"))
+        })
+    })
+})
@@ -0,0 +1,167 @@
+package push_handler
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "encoding/json"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// dispatch meta describing the push, added when push meta is enabled.  the
+// job must declare these keys in its parameterized stanza's meta_optional.
+const (
+    providerMetaKey     = "provider"
+    repoFullNameMetaKey = "repo_full_name"
+    cloneURLMetaKey     = "clone_url"
+    refMetaKey          = "ref"
+    shaMetaKey          = "sha"
+    pusherMetaKey       = "pusher"
+    deliveryIdMetaKey   = "delivery_id"
+    pullRequestMetaKey  = "pull_request"
+    baseRefMetaKey      = "base_ref"
+)
+
+// adds well-known dispatch meta to every dispatch.  tokens can override this
+// with "push_meta".
+func (self *PushHandler) EnablePushMeta() {
+    self.pushMeta = true
+}
+
+// the well-known meta for a push event.  values the provider didn't supply
+// are omitted.
+func pushEventMeta(pushEvent *forge.PushEvent) map[string]string {
+    meta := map[string]string{}
+
+    values := map[string]string{
+        providerMetaKey:     pushEvent.Provider,
+        repoFullNameMetaKey: pushEvent.RepoFullName,
+        cloneURLMetaKey:     pushEvent.CloneURL,
+        refMetaKey:          pushEvent.Ref,
+        shaMetaKey:          pushEvent.After,
+        pusherMetaKey:       pushEvent.Pusher,
+        deliveryIdMetaKey:   pushEvent.DeliveryID,
+    }
+
+    if pushEvent.PullRequest != nil {
+        values[pullRequestMetaKey] = strconv.Itoa(pushEvent.PullRequest.Number)
+        values[baseRefMetaKey] = pushEvent.PullRequest.BaseRef
+    }
+
+    for k, v := range values {
+        if v != "" {
+            meta[k] = v
+        }
+    }
+
+    return meta
+}
+
+// a path into a JSON document, like "$.repository.owner.login" or
+// "commits[0].author.email".  each element is a string key or an int index.
+type fieldPath []interface{}
+
+func parseFieldPath(expr string) (fieldPath, error) {
+    path := fieldPath{}
+
+    trimmed := strings.TrimPrefix(strings.TrimPrefix(expr, "$"), ".")
+    if trimmed == "" {
+        return nil, fmt.Errorf("empty field path %q", expr)
+    }
+
+    for _, segment := range strings.Split(trimmed, ".") {
+        key := segment
+        indexes := []int{}
+
+        if bracket := strings.Index(segment, "["); bracket >= 0 {
+            key = segment[:bracket]
+
+            for rest := segment[bracket:]; rest != ""; {
+                end := strings.Index(rest, "]")
+                if ! strings.HasPrefix(rest, "[") || end < 0 {
+                    return nil, fmt.Errorf("malformed index in field path %q", expr)
+                }
+
+                index, err := strconv.Atoi(rest[1:end])
+                if err != nil || index < 0 {
+                    return nil, fmt.Errorf("malformed index in field path %q", expr)
+                }
+
+                indexes = append(indexes, index)
+                rest = rest[end+1:]
+            }
+        }
+
+        if key == "" && len(indexes) == 0 {
+            return nil, fmt.Errorf("empty segment in field path %q", expr)
+        }
+
+        if key != "" {
+            path = append(path, key)
+        }
+
+        for _, index := range indexes {
+            path = append(path, index)
+        }
+    }
+
+    return path, nil
+}
+
+// returns the value at the path in a document decoded by encoding/json
+func (self fieldPath) lookup(doc interface{}) (interface{}, bool) {
+    for _, elem := range self {
+        switch elem := elem.(type) {
+            case string:
+                obj, ok := doc.(map[string]interface{})
+                if ! ok {
+                    return nil, false
+                }
+
+                if doc, ok = obj[elem]; ! ok {
+                    return nil, false
+                }
+
+            case int:
+                list, ok := doc.([]interface{})
+                if ! ok || elem >= len(list) {
+                    return nil, false
+                }
+
+                doc = list[elem]
+        }
+    }
+
+    return doc, true
+}
+
+// extracts the token's meta_fields from the payload.  strings are used as-is;
+// other values are JSON-encoded.  fields that are missing or null are omitted.
+func extractMetaFields(fields map[string]fieldPath, body []byte) map[string]string {
+    meta := map[string]string{}
+    if len(fields) == 0 {
+        return meta
+    }
+
+    var doc interface{}
+    if err := json.Unmarshal(body, &doc); err != nil {
+        return meta
+    }
+
+    for key, path := range fields {
+        val, ok := path.lookup(doc)
+        if ! ok || val == nil {
+            continue
+        }
+
+        if str, ok := val.(string); ok {
+            meta[key] = str
+        } else if encoded, err := json.Marshal(val); err == nil {
+            meta[key] = string(encoded)
+        }
+    }
+
+    return meta
+}
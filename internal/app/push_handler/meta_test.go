@@ -0,0 +1,213 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+var _ = Describe("dispatch meta", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    pushMeta := map[string]string{
+        "provider":       "github",
+        "repo_full_name": "nomad-ci/push-handler-service",
+        "clone_url":      "https://github.com/nomad-ci/push-handler-service.git",
+        "ref":            "refs/heads/master",
+        "sha":            "024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7",
+        "pusher":         "blalor",
+        "delivery_id":    "some-uuid",
+    }
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+    })
+
+    withSecretData := func(data map[string]interface{}) {
+        data["secret"] = "011746565c10e8c64df18d8724bc542da584433c"
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: data}, nil)
+    }
+
+    expectDispatch := func(meta map[string]string) {
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                meta,
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    }
+
+    push := func() {
+        req, err := http.NewRequest(
+            "POST",
+            "http://example.com/notify/push/github/some-auth-token",
+            strings.NewReader(githubPushEventExamplePayload),
+        )
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
+
+        router.ServeHTTP(resp, req)
+    }
+
+    It("should describe the push when enabled", func() {
+        ph.EnablePushMeta()
+        withSecretData(map[string]interface{} {})
+        expectDispatch(pushMeta)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+    })
+
+    It("should let the token disable push meta", func() {
+        ph.EnablePushMeta()
+        withSecretData(map[string]interface{} {
+            "push_meta": "false",
+        })
+        expectDispatch(map[string]string{})
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+    })
+
+    It("should let the token enable push meta", func() {
+        withSecretData(map[string]interface{} {
+            "push_meta": true,
+        })
+        expectDispatch(pushMeta)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+    })
+
+    It("should map payload fields into meta", func() {
+        withSecretData(map[string]interface{} {
+            "meta_fields": `{
+                "owner": "$.repository.owner.login",
+                "first_commit": "commits[0].id",
+                "author": "head_commit.author",
+                "stars": "$.repository.stargazers_count",
+                "missing": "$.repository.nothing_here"
+            }`,
+        })
+
+        expectDispatch(map[string]string{
+            "owner":        "nomad-ci",
+            "first_commit": "0b85e806493942b8e30ee58b5b14de63c908cdd7",
+            "author":       `{"email":"blalor@bravo5.org","name":"Brian Lalor","username":"blalor"}`,
+            "stars":        "0",
+        })
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+    })
+
+    It("should return 500 for a malformed field path", func() {
+        withSecretData(map[string]interface{} {
+            "meta_fields": map[string]interface{} {
+                "first_commit": "commits[first].id",
+            },
+        })
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should find superseded jobs by their push meta", func() {
+        withSecretData(map[string]interface{} {
+            "push_meta":         "true",
+            "cancel_superseded": "true",
+        })
+
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return(
+                []*nomadapi.JobListStub{
+                    {ID: dispatchJobId + "/dispatch-1", ParentID: dispatchJobId, Status: "running"},
+                },
+                &nomadapi.QueryMeta{},
+                nil,
+            )
+
+        // a payload that doesn't identify the build, as from a template
+        mockNomadJobs.
+            On("Info", dispatchJobId + "/dispatch-1", mock.AnythingOfType("*api.QueryOptions")).
+            Return(
+                &nomadapi.Job{
+                    Meta:    pushMeta,
+                    Payload: []byte("REF=refs/heads/master\n"),
+                },
+                &nomadapi.QueryMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("Deregister", dispatchJobId + "/dispatch-1", false, mock.AnythingOfType("*api.WriteOptions")).
+            Return("cafedead-beef-cafe-dead-beefcafedead", &nomadapi.WriteMeta{}, nil)
+
+        expectDispatch(pushMeta)
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+    })
+})
@@ -0,0 +1,122 @@
+package push_handler
+
+import (
+    "fmt"
+
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+const (
+    // the original clone_url, ref and sha payload, which pull requests extend
+    PayloadSchemaLegacy = "legacy"
+
+    // structs.DispatchPayload
+    PayloadSchemaV1 = "v1"
+)
+
+func validatePayloadSchema(schema string) error {
+    switch schema {
+        case PayloadSchemaLegacy, PayloadSchemaV1:
+            return nil
+    }
+
+    return fmt.Errorf("unknown payload schema %q", schema)
+}
+
+// sets the payload schema for tokens that don't set "payload_schema"
+func (self *PushHandler) SetPayloadSchema(schema string) error {
+    if err := validatePayloadSchema(schema); err != nil {
+        return err
+    }
+
+    self.payloadSchema = schema
+
+    return nil
+}
+
+// the payload for the clone job, in the given schema
+func dispatchPayload(schema string, pushEvent *forge.PushEvent) interface{} {
+    if schema == PayloadSchemaV1 {
+        return versionedDispatchPayload(pushEvent)
+    }
+
+    return legacyDispatchPayload(pushEvent)
+}
+
+// pull requests get a superset of the push payload
+func legacyDispatchPayload(pushEvent *forge.PushEvent) interface{} {
+    clonePayload := structs.CloneDispatchPayload{
+        CloneURL: pushEvent.CloneURL,
+        Ref:      pushEvent.Ref,
+        SHA:      pushEvent.After,
+    }
+
+    if pushEvent.PullRequest == nil {
+        return clonePayload
+    }
+
+    return structs.PullRequestDispatchPayload{
+        CloneDispatchPayload: clonePayload,
+
+        PullRequest:  pushEvent.PullRequest.Number,
+        BaseRef:      pushEvent.PullRequest.BaseRef,
+        BaseCloneURL: pushEvent.PullRequest.BaseCloneURL,
+        MergeRef:     pushEvent.PullRequest.MergeRef,
+    }
+}
+
+// json lists are never null, so consumers can iterate them unconditionally
+func nonNil(list []string) []string {
+    if list == nil {
+        return []string{}
+    }
+
+    return list
+}
+
+func versionedDispatchPayload(pushEvent *forge.PushEvent) structs.DispatchPayload {
+    payload := structs.DispatchPayload{
+        SchemaVersion: structs.DispatchPayloadSchemaVersion,
+
+        Provider:   pushEvent.Provider,
+        Event:      pushEvent.Event,
+        DeliveryID: pushEvent.DeliveryID,
+
+        Repository: structs.DispatchRepository{
+            FullName: pushEvent.RepoFullName,
+            CloneURL: pushEvent.CloneURL,
+        },
+
+        Ref:    pushEvent.Ref,
+        Before: pushEvent.Before,
+        After:  pushEvent.After,
+
+        Pusher: pushEvent.Pusher,
+    }
+
+    if pushEvent.Commits != nil {
+        payload.Commits = []structs.DispatchCommit{}
+
+        for _, commit := range pushEvent.Commits {
+            payload.Commits = append(payload.Commits, structs.DispatchCommit{
+                ID:       commit.ID,
+                Message:  commit.Message,
+                Added:    nonNil(commit.Added),
+                Modified: nonNil(commit.Modified),
+                Removed:  nonNil(commit.Removed),
+            })
+        }
+    }
+
+    if pushEvent.PullRequest != nil {
+        payload.PullRequest = &structs.DispatchPullRequest{
+            Number:       pushEvent.PullRequest.Number,
+            BaseRef:      pushEvent.PullRequest.BaseRef,
+            BaseCloneURL: pushEvent.PullRequest.BaseCloneURL,
+            MergeRef:     pushEvent.PullRequest.MergeRef,
+        }
+    }
+
+    return payload
+}
@@ -0,0 +1,230 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+)
+
+var _ = Describe("dispatch payload schema", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    withSecretData := func(data map[string]interface{}) {
+        data["secret"] = "011746565c10e8c64df18d8724bc542da584433c"
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: data}, nil)
+    }
+
+    deliver := func(event, payload string) {
+        req, err := http.NewRequest("POST", "http://example.com/notify/push/github/some-auth-token", strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", event)
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("011746565c10e8c64df18d8724bc542da584433c", payload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    dispatchedPayload := func(payload interface{}) {
+        Expect(json.Unmarshal(mockNomadJobs.Calls[0].Arguments[2].([]byte), payload)).ShouldNot(HaveOccurred())
+    }
+
+    It("should dispatch the versioned payload for a push", func() {
+        withSecretData(map[string]interface{} {
+            "payload_schema": "v1",
+        })
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload structs.DispatchPayload
+        dispatchedPayload(&payload)
+
+        Expect(payload).To(Equal(structs.DispatchPayload{
+            SchemaVersion: 1,
+
+            Provider:   "github",
+            Event:      "push",
+            DeliveryID: "some-uuid",
+
+            Repository: structs.DispatchRepository{
+                FullName: "nomad-ci/push-handler-service",
+                CloneURL: "https://github.com/nomad-ci/push-handler-service.git",
+            },
+
+            Ref:    "refs/heads/master",
+            Before: "0000000000000000000000000000000000000000",
+            After:  "024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7",
+
+            Commits: []structs.DispatchCommit{
+                {
+                    ID:       "0b85e806493942b8e30ee58b5b14de63c908cdd7",
+                    Message:  "repo create",
+                    Added:    []string{},
+                    Modified: []string{},
+                    Removed:  []string{},
+                },
+                {
+                    ID:       "024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7",
+                    Message:  "dep init",
+                    Added:    []string{"Gopkg.lock", "Gopkg.toml"},
+                    Modified: []string{},
+                    Removed:  []string{},
+                },
+            },
+
+            Pusher: "blalor",
+        }))
+    })
+
+    It("should dispatch the versioned payload for a pull request", func() {
+        Expect(ph.SetPayloadSchema("v1")).To(Succeed())
+        withSecretData(map[string]interface{} {})
+
+        deliver("pull_request", strings.Replace(githubPullRequestEventExamplePayload, "%s", "opened", 1))
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload structs.DispatchPayload
+        dispatchedPayload(&payload)
+
+        Expect(payload.Event).To(Equal("pull_request"))
+        Expect(payload.Repository.CloneURL).To(Equal("https://github.com/forker/Hello-World.git"))
+        Expect(payload.Commits).To(BeNil())
+        Expect(payload.PullRequest).To(Equal(&structs.DispatchPullRequest{
+            Number:       2,
+            BaseRef:      "refs/heads/master",
+            BaseCloneURL: "https://github.com/Codertocat/Hello-World.git",
+            MergeRef:     "refs/pull/2/merge",
+        }))
+    })
+
+    It("should let the token ask for the legacy payload", func() {
+        Expect(ph.SetPayloadSchema("v1")).To(Succeed())
+        withSecretData(map[string]interface{} {
+            "payload_schema": "legacy",
+        })
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        var payload map[string]interface{}
+        dispatchedPayload(&payload)
+
+        Expect(payload).To(Equal(map[string]interface{}{
+            "clone_url": "https://github.com/nomad-ci/push-handler-service.git",
+            "ref":       "refs/heads/master",
+            "sha":       "024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7",
+        }))
+    })
+
+    It("should return 500 for an unknown schema", func() {
+        withSecretData(map[string]interface{} {
+            "payload_schema": "v2",
+        })
+
+        deliver("push", githubPushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should reject an unknown default schema", func() {
+        Expect(ph.SetPayloadSchema("v2")).ToNot(Succeed())
+    })
+
+    It("should identify jobs dispatched with the versioned payload", func() {
+        withSecretData(map[string]interface{} {})
+
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return(
+                []*nomadapi.JobListStub{
+                    {ID: dispatchJobId + "/dispatch-1", ParentID: dispatchJobId, Status: "running"},
+                },
+                &nomadapi.QueryMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("Info", dispatchJobId + "/dispatch-1", mock.AnythingOfType("*api.QueryOptions")).
+            Return(
+                dispatchedJob(structs.DispatchPayload{
+                    SchemaVersion: 1,
+                    Repository: structs.DispatchRepository{
+                        CloneURL: "https://github.com/Codertocat/Hello-World.git",
+                    },
+                    Ref: "refs/heads/feature",
+                }),
+                &nomadapi.QueryMeta{},
+                nil,
+            )
+
+        mockNomadJobs.
+            On("Deregister", dispatchJobId + "/dispatch-1", false, mock.AnythingOfType("*api.WriteOptions")).
+            Return("cafedead-beef-cafe-dead-beefcafedead", &nomadapi.WriteMeta{}, nil)
+
+        deliver("push", githubDeletePushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        mockNomadJobs.AssertCalled(GinkgoT(), "Deregister", dispatchJobId + "/dispatch-1", false, mock.AnythingOfType("*api.WriteOptions"))
+    })
+})
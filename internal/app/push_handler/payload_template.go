@@ -0,0 +1,141 @@
+package push_handler
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "text/template"
+
+    "encoding/json"
+
+    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// functions available to payload templates.  string arguments come last so
+// they can be used in pipelines, like {{ .Ref | trimPrefix "refs/heads/" }}.
+var payloadTemplateFuncs = template.FuncMap{
+    "json": func(val interface{}) (string, error) {
+        encoded, err := json.Marshal(val)
+        return string(encoded), err
+    },
+
+    // quotes a string for a posix shell, like an env file sourced by a task
+    "shellQuote": func(str string) string {
+        return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+    },
+
+    "lower":      strings.ToLower,
+    "upper":      strings.ToUpper,
+    "trim":       strings.TrimSpace,
+    "trimPrefix": func(prefix, str string) string { return strings.TrimPrefix(str, prefix) },
+    "trimSuffix": func(suffix, str string) string { return strings.TrimSuffix(str, suffix) },
+    "replace":    func(old, new, str string) string { return strings.Replace(str, old, new, -1) },
+    "hasPrefix":  func(prefix, str string) bool { return strings.HasPrefix(str, prefix) },
+    "hasSuffix":  func(suffix, str string) bool { return strings.HasSuffix(str, suffix) },
+    "contains":   func(substr, str string) bool { return strings.Contains(str, substr) },
+    "split":      func(sep, str string) []string { return strings.Split(str, sep) },
+    "join":       func(sep string, list []string) string { return strings.Join(list, sep) },
+}
+
+// payloads for checking templates before they're used: a pull request
+// exercising every field, and a push with only the fields every push has
+var payloadTemplateSample = structs.DispatchPayload{
+    SchemaVersion: structs.DispatchPayloadSchemaVersion,
+
+    Provider:   "github",
+    Event:      "pull_request",
+    DeliveryID: "72d3162e-cc78-11e3-81ab-4c9367dc0958",
+
+    Repository: structs.DispatchRepository{
+        FullName: "octocat/Hello-World",
+        CloneURL: "https://github.com/octocat/Hello-World.git",
+    },
+
+    Ref:    "refs/heads/feature",
+    Before: "6113728f27ae82c7b1a177c8d03f9e96e0adf246",
+    After:  "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+
+    Commits: []structs.DispatchCommit{
+        {
+            ID:       "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+            Message:  "Update README.md",
+            Added:    []string{},
+            Modified: []string{"README.md"},
+            Removed:  []string{},
+        },
+    },
+
+    Pusher: "octocat",
+
+    PullRequest: &structs.DispatchPullRequest{
+        Number:       1,
+        BaseRef:      "refs/heads/master",
+        BaseCloneURL: "https://github.com/octocat/Hello-World.git",
+        MergeRef:     "refs/pull/1/merge",
+    },
+}
+
+var payloadTemplatePushSample = structs.DispatchPayload{
+    SchemaVersion: structs.DispatchPayloadSchemaVersion,
+
+    Provider: "bitbucket-server",
+    Event:    "push",
+
+    Repository: structs.DispatchRepository{
+        CloneURL: "https://bitbucket.example.com/scm/project/repo.git",
+    },
+
+    Ref:   "refs/heads/master",
+    After: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+}
+
+// parses a payload template and renders it with sample payloads, so that
+// references to fields that don't exist, or that pushes don't have, like
+// {{ .PullRequest.Number }} without a guard, are caught up front
+func ParsePayloadTemplate(name, text string) (*template.Template, error) {
+    tmpl, err := template.New(name).Funcs(payloadTemplateFuncs).Parse(text)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, sample := range []structs.DispatchPayload{payloadTemplateSample, payloadTemplatePushSample} {
+        if err := tmpl.Execute(ioutil.Discard, sample); err != nil {
+            return nil, fmt.Errorf("unable to render a %s payload: %s", sample.Event, err)
+        }
+    }
+
+    return tmpl, nil
+}
+
+// reads and validates the default payload template
+func ReadPayloadTemplate(filename string) (*template.Template, error) {
+    text, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    return ParsePayloadTemplate(filename, string(text))
+}
+
+// renders the dispatch payload with the template for tokens that don't set
+// "payload_template", instead of encoding it as JSON
+func (self *PushHandler) SetPayloadTemplate(tmpl *template.Template) {
+    self.payloadTemplate = tmpl
+}
+
+// the dispatch payload: the token's template rendered with the v1 payload, or
+// the payload in the token's schema encoded as JSON
+func renderDispatchPayload(cfg *webhookConfig, pushEvent *forge.PushEvent) ([]byte, error) {
+    if cfg.PayloadTemplate == nil {
+        return json.Marshal(dispatchPayload(cfg.PayloadSchema, pushEvent))
+    }
+
+    var rendered bytes.Buffer
+    if err := cfg.PayloadTemplate.Execute(&rendered, versionedDispatchPayload(pushEvent)); err != nil {
+        return nil, err
+    }
+
+    return rendered.Bytes(), nil
+}
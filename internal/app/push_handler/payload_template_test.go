@@ -0,0 +1,209 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+var _ = Describe("payload templates", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    dispatchJobId := "clone-some-repo"
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            dispatchJobId,
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                dispatchJobId,
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    withSecretData := func(data map[string]interface{}) {
+        data["secret"] = "011746565c10e8c64df18d8724bc542da584433c"
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: data}, nil)
+    }
+
+    pushPayload := func(payload string) {
+        req, err := http.NewRequest(
+            "POST",
+            "http://example.com/notify/push/github/some-auth-token",
+            strings.NewReader(payload),
+        )
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("011746565c10e8c64df18d8724bc542da584433c", payload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    push := func() {
+        pushPayload(githubPushEventExamplePayload)
+    }
+
+    dispatchedPayload := func() string {
+        return string(mockNomadJobs.Calls[0].Arguments[2].([]byte))
+    }
+
+    It("should render the default template", func() {
+        tmpl, err := ParsePayloadTemplate("env", strings.Join([]string{
+            `CLONE_URL={{ .Repository.CloneURL | shellQuote }}`,
+            `BRANCH={{ .Ref | trimPrefix "refs/heads/" | shellQuote }}`,
+            `SHA={{ .After }}`,
+            `MESSAGES={{ range .Commits }}{{ .Message | upper }};{{ end }}`,
+            ``,
+        }, "\n"))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        ph.SetPayloadTemplate(tmpl)
+        withSecretData(map[string]interface{} {})
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        Expect(dispatchedPayload()).To(Equal(strings.Join([]string{
+            `CLONE_URL='https://github.com/nomad-ci/push-handler-service.git'`,
+            `BRANCH='master'`,
+            `SHA=024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7`,
+            `MESSAGES=REPO CREATE;DEP INIT;`,
+            ``,
+        }, "\n")))
+    })
+
+    It("should prefer the token's template", func() {
+        tmpl, err := ParsePayloadTemplate("default", `{{ .Ref }}`)
+        Expect(err).ShouldNot(HaveOccurred())
+
+        ph.SetPayloadTemplate(tmpl)
+        withSecretData(map[string]interface{} {
+            "payload_template": `source { url = {{ json .Repository.CloneURL }} ref = {{ json .After }} }`,
+        })
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        Expect(dispatchedPayload()).To(Equal(`source { url = "https://github.com/nomad-ci/push-handler-service.git" ref = "024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7" }`))
+    })
+
+    It("should return 500 for an invalid token template", func() {
+        withSecretData(map[string]interface{} {
+            "payload_template": `{{ .Ref `,
+        })
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should not look for jobs to stop for a deleted ref without push meta", func() {
+        withSecretData(map[string]interface{} {
+            "payload_template": `{{ .Ref }}`,
+        })
+
+        pushPayload(githubDeletePushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should look for jobs to stop for a deleted ref with push meta", func() {
+        withSecretData(map[string]interface{} {
+            "payload_template": `{{ .Ref }}`,
+            "push_meta":        "true",
+        })
+
+        mockNomadJobs.
+            On("List", mock.AnythingOfType("*api.QueryOptions")).
+            Return([]*nomadapi.JobListStub{}, &nomadapi.QueryMeta{}, nil)
+
+        pushPayload(githubDeletePushEventExamplePayload)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "List", 1)
+    })
+
+    It("should return 500 for cancel_superseded with a template but without push meta", func() {
+        withSecretData(map[string]interface{} {
+            "payload_template":  `{{ .Ref }}`,
+            "cancel_superseded": "true",
+        })
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should reject syntax errors", func() {
+        _, err := ParsePayloadTemplate("broken", `{{ if .Ref }}`)
+        Expect(err).Should(MatchError(ContainSubstring("broken")))
+    })
+
+    It("should reject unknown fields", func() {
+        _, err := ParsePayloadTemplate("unknown", `{{ .Branch }}`)
+        Expect(err).Should(MatchError(ContainSubstring("Branch")))
+    })
+
+    It("should reject fields that pushes don't have", func() {
+        _, err := ParsePayloadTemplate("pull-request", `PR={{ .PullRequest.Number }}`)
+        Expect(err).Should(MatchError(ContainSubstring("push payload")))
+
+        _, err = ParsePayloadTemplate("pull-request", `{{ with .PullRequest }}PR={{ .Number }}{{ end }}`)
+        Expect(err).ShouldNot(HaveOccurred())
+    })
+
+    It("should reject unknown functions", func() {
+        _, err := ParsePayloadTemplate("unknown", `{{ .Ref | base64 }}`)
+        Expect(err).Should(MatchError(ContainSubstring("base64")))
+    })
+})
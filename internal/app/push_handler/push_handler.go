@@ -1,9 +1,11 @@
 package push_handler
 
-// the push handlers consume requests like /notify/push/github/<token>.  the
-// <token> is looked up in Vault, and the payload is used to validate the
-// request.  in the case of github, the hmac secret is contained in the Vault
-// secret and shared with github, which uses it to sign the payload.
+// the push handlers consume requests like /notify/push/<provider>/<token>.  the
+// <token> is looked up in Vault under the provider's name, and the Provider
+// uses the secret to validate the request.  in the case of github, the hmac
+// secret is contained in the Vault secret and shared with github, which uses
+// it to sign the payload.  gitlab doesn't sign payloads; it sends the shared
+// secret back in a header instead.
 
 import (
     "fmt"
@@ -12,31 +14,45 @@ import (
     "net"
     "net/http"
     "path"
+    "strconv"
+    "strings"
+    "time"
+    "text/template"
 
+    "hash"
     "crypto/hmac"
-    "crypto/sha1"
+    "crypto/sha256"
     "encoding/hex"
     "encoding/json"
 
     log "github.com/Sirupsen/logrus"
 
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+
     "github.com/gorilla/mux"
-    "github.com/google/go-github/github"
 
     "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
-    "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
 )
 
 // error returned when request preflight fails
 type preflightError struct {
     msg string
     statusCode int
+
+    // if set, sent as Retry-After so the provider retries the delivery
+    retryAfter time.Duration
 }
 
 func newPreflightError(msg string, statusCode int) *preflightError {
-    return &preflightError{msg, statusCode}
+    return &preflightError{msg: msg, statusCode: statusCode}
 }
 
+// how long providers are asked to wait before retrying a delivery that failed
+// because Vault couldn't be read
+const vaultRetryAfter = 30 * time.Second
+
 func (self *preflightError) Error() string {
     return self.msg
 }
@@ -46,6 +62,17 @@ type PushHandler struct {
     webhookTokenPrefix string
     nomad              interfaces.NomadJobs
     dispatchId         string
+    providers          map[string]forge.Provider
+    deliveries         *deliveryTracker
+    defaultRules       Rules
+    skipDirectives     skipDirectives
+    pushMeta           bool
+    payloadSchema      string
+    payloadTemplate    *template.Template
+
+    // the KV v2 mount webhook secrets are read from, like "secret/"; empty for
+    // KV v1
+    kvMount string
 }
 
 func NewPushHandler(
@@ -54,173 +81,461 @@ func NewPushHandler(
     nomad interfaces.NomadJobs,
     dispatchId string,
 ) *PushHandler {
-    return &PushHandler{
+    ph := &PushHandler{
         vault:              vault,
         webhookTokenPrefix: tokenPrefix,
         nomad:              nomad,
         dispatchId:         dispatchId,
+        providers:          map[string]forge.Provider{},
+        payloadSchema:      PayloadSchemaLegacy,
     }
+
+    ph.RegisterProvider("github",           &gitHubProvider{})
+    ph.RegisterProvider("gitlab",           &gitLabProvider{})
+    ph.RegisterProvider("bitbucket",        &bitbucketProvider{})
+    ph.RegisterProvider("bitbucket-server", &bitbucketServerProvider{})
+    ph.RegisterProvider("gitea",            &giteaProvider{})
+    ph.RegisterProvider("azure-devops",     &azureDevOpsProvider{})
+
+    return ph
 }
 
-func (self *PushHandler) InstallHandlers(router *mux.Router) {
-    router.
-        Methods("POST").
-        Path("/github/{auth_token}").
-        Headers(
-            "Content-Type", "application/json",
-            "X-Github-Event", "push",
-        ).
-        HandlerFunc(self.GitHubPushEvent)
+// makes a provider available at /<name>/<token>.  the name is also the Vault
+// path component for the provider's webhook secrets.  registering an existing
+// name replaces it.
+func (self *PushHandler) RegisterProvider(name string, provider forge.Provider) {
+    self.providers[name] = provider
+}
 
+// ignores deliveries that were already handled within the window, as
+// identified by providers implementing DeliveryIdentifier
+func (self *PushHandler) EnableReplayProtection(window time.Duration) {
+    self.deliveries = newDeliveryTracker(window)
+}
+
+// sets the rules for tokens that don't set their own
+func (self *PushHandler) SetDefaultRules(rules Rules) {
+    self.defaultRules = rules
+}
+
+func (self *PushHandler) InstallHandlers(router *mux.Router) {
+    // some providers include the charset in the content type
     router.
         Methods("POST").
-        Path("/github/{auth_token}").
-        Headers(
-            "Content-Type", "application/json",
-            "X-Github-Event", "ping",
-        ).
-        HandlerFunc(self.GitHubPingEvent)
+        Path("/{provider}/{auth_token}").
+        HeadersRegexp("Content-Type", "^application/json").
+        HandlerFunc(self.HandleEvent)
 }
 
-func checkGitHubMac(body []byte, secret, messageMAC string) bool {
-    if messageMAC[:5] != "sha1=" {
-        return false
+// checks a hex-encoded hmac signature of body, like the "sha256=<hex>" sent by
+// github, against each of the webhook's secrets.  the prefix is required and is
+// stripped before decoding.  signatures that couldn't have been produced by
+// hashFunc are rejected as malformed rather than as a mismatch.
+func checkSignature(hashFunc func() hash.Hash, body []byte, secrets []string, prefix, signature string) error {
+    if ! strings.HasPrefix(signature, prefix) {
+        return newPreflightError(fmt.Sprintf("malformed signature; expected %q prefix", prefix), http.StatusBadRequest)
     }
 
-    // strip off "sha1="
-    realMessageMac, err := hex.DecodeString(messageMAC[5:len(messageMAC)])
-    if err != nil {
-        return false
+    messageMAC, err := hex.DecodeString(signature[len(prefix):])
+    if err != nil || len(messageMAC) != hashFunc().Size() {
+        return newPreflightError("malformed signature", http.StatusBadRequest)
     }
 
-    mac := hmac.New(sha1.New, []byte(secret))
-    mac.Write(body)
-    expectedMAC := mac.Sum(nil)
+    for _, secret := range secrets {
+        mac := hmac.New(hashFunc, []byte(secret))
+        mac.Write(body)
+        expectedMAC := mac.Sum(nil)
 
+        if hmac.Equal(messageMAC, expectedMAC) {
+            return nil
+        }
+    }
 
-    return hmac.Equal(realMessageMac, expectedMAC)
+    return newPreflightError("bad payload signature", http.StatusForbidden)
 }
 
-func (self *PushHandler) preflightGitHubEvent(resp http.ResponseWriter, req *http.Request) ([]byte, *log.Entry, *preflightError) {
-    vars := mux.Vars(req)
+// returns true if key in the secret is boolean true, or a string like "true".
+// `vault write` stores everything as strings.
+func secretFlag(secret *vaultapi.Secret, key string) bool {
+    switch val := secret.Data[key].(type) {
+        case bool:
+            return val
 
-    var err error
-    var remoteAddr string
+        case string:
+            flag, _ := strconv.ParseBool(val)
+            return flag
+    }
 
-    if xff, ok := req.Header["X-Forwarded-For"]; ok {
-        remoteAddr = xff[0]
-    } else {
-        remoteAddr, _, err = net.SplitHostPort(req.RemoteAddr)
-        if err != nil {
-            log.Warnf("unable to parse RemoteAddr '%s': %s", remoteAddr, err)
-            remoteAddr = req.RemoteAddr
+    return false
+}
+
+// returns true for the all-zeros sha providers send as the "after" of a
+// deleted ref
+func isZeroSHA(sha string) bool {
+    return sha != "" && strings.Trim(sha, "0") == ""
+}
+
+// returns the commit with the given id, if the provider included it
+func findCommit(commits []*forge.Commit, id string) *forge.Commit {
+    for _, commit := range commits {
+        if commit.ID == id {
+            return commit
         }
     }
 
-    logEntry := log.
-        WithField("remote_ip", remoteAddr).
-        WithField("provider", "github").
-        WithField("auth_token", vars["auth_token"])
+    return nil
+}
 
-    // https://developer.github.com/webhooks/securing/
-    secret, _ := self.vault.Read(path.Join(self.webhookTokenPrefix, "github", vars["auth_token"]))
-    if secret == nil {
-        return nil, logEntry, newPreflightError(fmt.Sprintf("unauthorized webhook %s", vars["auth_token"]), http.StatusNotFound)
+// returns the address of the client that made the request, honoring
+// X-Forwarded-For
+func remoteAddress(req *http.Request) string {
+    if xff, ok := req.Header["X-Forwarded-For"]; ok {
+        return xff[0]
     }
 
-    hmacSecret := secret.Data["secret"].(string)
+    remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        log.Warnf("unable to parse RemoteAddr '%s': %s", req.RemoteAddr, err)
+        remoteAddr = req.RemoteAddr
+    }
 
-    var hubSignature string
-    if xhs, ok := req.Header["X-Hub-Signature"]; ok {
-        hubSignature = xhs[0]
-    } else {
-        return nil, logEntry, newPreflightError("no X-Hub-Signature header", http.StatusBadRequest)
+    return remoteAddr
+}
+
+// common flow for all providers: look up the auth token in Vault, read the
+// body, and hand both to the provider to authenticate.
+func (self *PushHandler) preflightEvent(req *http.Request, providerName string, provider forge.Provider) ([]byte, *vaultapi.Secret, *preflightError) {
+    vars := mux.Vars(req)
+
+    secret, preflightErr := self.readWebhookSecret(providerName, vars["auth_token"])
+    if preflightErr != nil {
+        return nil, nil, preflightErr
+    }
+
+    if secret == nil {
+        return nil, nil, newPreflightError(fmt.Sprintf("unauthorized webhook %s", vars["auth_token"]), http.StatusNotFound)
     }
 
     body, err := ioutil.ReadAll(req.Body)
     if err != nil {
-        return nil, logEntry, newPreflightError(fmt.Sprintf("unable to read body: %s", err), http.StatusBadRequest)
+        return nil, nil, newPreflightError(fmt.Sprintf("unable to read body: %s", err), http.StatusBadRequest)
     }
 
-    if ! checkGitHubMac(body, hmacSecret, hubSignature) {
-        return nil, logEntry, newPreflightError("bad payload signature", http.StatusForbidden)
+    err = provider.Authenticate(req, body, secret)
+    if preflightErr, ok := err.(*preflightError); ok {
+        return nil, nil, preflightErr
+    } else if requestErr, ok := err.(*forge.RequestError); ok {
+        return nil, nil, newPreflightError(requestErr.Error(), requestErr.StatusCode())
+    } else if err != nil {
+        return nil, nil, newPreflightError(err.Error(), http.StatusForbidden)
     }
 
-    return body, logEntry, nil
+    return body, secret, nil
 }
 
-// https://developer.github.com/v3/activity/events/types/#pushevent
-func (self *PushHandler) GitHubPushEvent(resp http.ResponseWriter, req *http.Request) {
-    body, logEntry, preflightErr := self.preflightGitHubEvent(resp, req)
+// handles every event for every provider
+func (self *PushHandler) HandleEvent(resp http.ResponseWriter, req *http.Request) {
+    vars := mux.Vars(req)
+
+    logEntry := log.
+        WithField("remote_ip", remoteAddress(req)).
+        WithField("provider", vars["provider"]).
+        WithField("auth_token", vars["auth_token"])
+
+    provider, ok := self.providers[vars["provider"]]
+    if ! ok {
+        logEntry.Errorf("unknown provider %s", vars["provider"])
+        resp.WriteHeader(http.StatusNotFound)
+        return
+    }
+
+    body, secret, preflightErr := self.preflightEvent(req, vars["provider"], provider)
     if preflightErr != nil {
         logEntry.Error(preflightErr.msg)
+
+        if preflightErr.retryAfter > 0 {
+            resp.Header().Set("Retry-After", strconv.Itoa(int(preflightErr.retryAfter / time.Second)))
+        }
+
         resp.WriteHeader(preflightErr.statusCode)
         return
     }
 
-    var payload github.PushEvent
-    err := json.Unmarshal(body, &payload)
+    cfg, err := self.parseWebhookConfig(secret)
     if err != nil {
-        logEntry.Errorf("unable to unmarshal body: %s", err)
-        resp.WriteHeader(http.StatusBadRequest)
+        logEntry.Errorf("malformed webhook config: %s", err)
+        resp.WriteHeader(http.StatusInternalServerError)
         return
     }
 
-    // create payload for dispatch
-    dispatchBytes, err := json.Marshal(structs.CloneDispatchPayload{
-        CloneURL: *payload.Repo.CloneURL,
-        Ref:      *payload.Ref,
-        SHA:      *payload.After,
-    })
-
-    if err != nil {
-        logEntry.Errorf("unable to marshal dispatch payload: %s", err)
-        resp.WriteHeader(http.StatusInternalServerError)
+    // acknowledged, since some forges disable webhooks that keep failing,
+    // and a hook may send more kinds of events than are built
+    eventType := provider.EventType(req, body)
+    if eventType == forge.EventUnsupported {
+        logEntry.Info("ignoring unsupported event")
+        resp.WriteHeader(http.StatusOK)
         return
     }
 
-    // actually dispatch the job to nomad
-    dispatchResp, _, err := self.nomad.Dispatch(
-        self.dispatchId,
-        map[string]string{},
-        dispatchBytes,
-        nil,
-    )
+    logEntry = logEntry.WithField("event", eventType)
 
+    pushEvents, err := provider.Normalize(eventType, body)
     if err != nil {
-        logEntry.Errorf("unable to dispatch job: %s", err)
-        resp.WriteHeader(http.StatusInternalServerError)
+        logEntry.Errorf("unable to unmarshal body: %s", err)
+        resp.WriteHeader(http.StatusBadRequest)
         return
     }
 
-    logEntry.Infof("dispatched %s with eval %s", dispatchResp.DispatchedJobID, dispatchResp.EvalID)
+    var deliveryID string
+    if identifier, ok := provider.(forge.DeliveryIdentifier); ok {
+        deliveryID = identifier.DeliveryID(req, body)
+    }
+
+    for _, pushEvent := range pushEvents {
+        pushEvent.Provider = vars["provider"]
+        pushEvent.Event = string(eventType)
+        pushEvent.DeliveryID = deliveryID
+
+        if err := cfg.applyCloneURLs(pushEvent); err != nil {
+            logEntry.Errorf("unable to choose clone url: %s", err)
+            resp.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+    }
+
+    var deliveryKey string
+    if deliveryID != "" {
+        logEntry = logEntry.WithField("delivery_id", deliveryID)
+    }
 
-    resp.WriteHeader(http.StatusAccepted)
+    if deliveryID != "" && self.deliveries != nil {
+        deliveryKey = replayKey(vars["provider"], vars["auth_token"], body)
+
+        // only claimed after authenticating, so forged requests can't block
+        // legitimate deliveries
+        if ! self.deliveries.claim(deliveryKey, time.Now()) {
+            logEntry.Info("ignoring redelivery")
+            resp.WriteHeader(http.StatusOK)
+            return
+        }
+    }
+
+    fieldMeta := extractMetaFields(cfg.MetaFields, body)
+
+    if ! self.dispatchClones(resp, logEntry, cfg, deliveryKey, pushEvents, fieldMeta) && deliveryKey != "" {
+        self.deliveries.release(deliveryKey)
+    }
 }
 
-// https://developer.github.com/webhooks/#ping-event
-func (self *PushHandler) GitHubPingEvent(resp http.ResponseWriter, req *http.Request) {
-    body, logEntry, preflightErr := self.preflightGitHubEvent(resp, req)
-    if preflightErr != nil {
-        logEntry.Error(preflightErr.msg)
-        resp.WriteHeader(preflightErr.statusCode)
-        return
+// identifies a delivery for replay protection.  the delivery id isn't covered
+// by the signature, so a replayed body could carry a fresh one; the body is,
+// and it's the same when the provider retries the delivery.
+func replayKey(providerName, authToken string, body []byte) string {
+    digest := sha256.Sum256(body)
+
+    return path.Join(providerName, authToken, hex.EncodeToString(digest[:]))
+}
+
+// the meta for a dispatch.  push meta, when enabled, is overridden by the
+// token's static meta, and that by its meta_fields.
+func dispatchMeta(cfg *webhookConfig, pushEvent *forge.PushEvent, fieldMeta map[string]string, target dispatchTarget) map[string]string {
+    meta := map[string]string{}
+
+    if cfg.PushMeta {
+        for k, v := range pushEventMeta(pushEvent) {
+            meta[k] = v
+        }
     }
 
-    var payload github.PingEvent
-    err := json.Unmarshal(body, &payload)
-    if err != nil {
-        logEntry.Errorf("unable to unmarshal body: %s", err)
-        resp.WriteHeader(http.StatusBadRequest)
-        return
+    for k, v := range cfg.Meta {
+        meta[k] = v
+    }
+
+    for k, v := range fieldMeta {
+        meta[k] = v
+    }
+
+    if target.Subproject != "" {
+        meta[subprojectMetaKey] = target.Subproject
+    }
+
+    return meta
+}
+
+// identifies a dispatch within a delivery
+func dispatchKey(pushEvent *forge.PushEvent, target dispatchTarget) string {
+    return strings.Join([]string{pushEvent.Ref, target.JobId, target.Subproject}, "\x00")
+}
+
+// a single dispatch, as reported in the response body
+type dispatchResult struct {
+    Ref             string `json:"ref"`
+    JobId           string `json:"job_id"`
+    Subproject      string `json:"subproject,omitempty"`
+    DispatchedJobId string `json:"dispatched_job_id,omitempty"`
+    EvalId          string `json:"eval_id,omitempty"`
+    Error           string `json:"error,omitempty"`
+}
+
+func failedDispatch(pushEvent *forge.PushEvent, target dispatchTarget, err error) dispatchResult {
+    return dispatchResult{
+        Ref:        pushEvent.Ref,
+        JobId:      target.JobId,
+        Subproject: target.Subproject,
+        Error:      err.Error(),
+    }
+}
+
+type dispatchResponse struct {
+    Dispatched []dispatchResult `json:"dispatched"`
+    Failed     []dispatchResult `json:"failed,omitempty"`
+}
+
+func writeJSON(resp http.ResponseWriter, statusCode int, body interface{}) {
+    resp.Header().Set("Content-Type", "application/json")
+    resp.WriteHeader(statusCode)
+
+    if err := json.NewEncoder(resp).Encode(body); err != nil {
+        log.Errorf("unable to write response: %s", err)
+    }
+}
+
+// dispatches the jobs for each ref, or stops them for a deleted ref, and writes
+// the response listing what was dispatched and what failed.  a failure doesn't
+// stop the remaining refs.  returns false if the delivery should be retried.
+func (self *PushHandler) dispatchClones(resp http.ResponseWriter, logEntry *log.Entry, cfg *webhookConfig, deliveryKey string, pushEvents []*forge.PushEvent, fieldMeta map[string]string) bool {
+    result := dispatchResponse{
+        Dispatched: []dispatchResult{},
+    }
+
+    skippedByDirective := 0
+
+    for _, pushEvent := range pushEvents {
+        if reason := cfg.Rules.skipReason(pushEvent); reason != "" {
+            logEntry.Infof("not dispatching %s: %s", pushEvent.Ref, reason)
+            continue
+        }
+
+        if directive := self.skipDirectives.match(pushEvent); directive != "" {
+            logEntry.Infof("not dispatching %s: commit message contains %s", pushEvent.Ref, directive)
+            skippedByDirective++
+            continue
+        }
+
+        targets := cfg.dispatchTargets(pushEvent)
+        if len(targets) == 0 {
+            logEntry.Infof("not dispatching %s: no subprojects changed", pushEvent.Ref)
+            continue
+        }
+
+        if pushEvent.Deleted && ! cfg.findsDispatchedJobs() {
+            logEntry.Warnf("not stopping jobs for deleted %s: jobs dispatched with a payload template can only be found with push meta", pushEvent.Ref)
+            continue
+        }
+
+        if pushEvent.Deleted {
+            for _, target := range targets {
+                err := self.stopDispatchedJobs(logEntry, cfg, target.JobId, pushEvent, sameRef(pushEvent))
+                if err != nil {
+                    logEntry.Errorf("unable to stop jobs for deleted %s: %s", pushEvent.Ref, err)
+                    result.Failed = append(result.Failed, failedDispatch(pushEvent, target, err))
+                }
+            }
+
+            continue
+        }
+
+        // create payload for dispatch
+        dispatchBytes, err := renderDispatchPayload(cfg, pushEvent)
+
+        if err != nil {
+            logEntry.Errorf("unable to render dispatch payload: %s", err)
+
+            for _, target := range targets {
+                result.Failed = append(result.Failed, failedDispatch(pushEvent, target, err))
+            }
+
+            continue
+        }
+
+        for _, target := range targets {
+            key := dispatchKey(pushEvent, target)
+
+            if deliveryKey != "" {
+                if previous, ok := self.deliveries.previousDispatch(deliveryKey, key); ok {
+                    logEntry.Infof("already dispatched %s for %s", previous.DispatchedJobId, pushEvent.Ref)
+
+                    result.Dispatched = append(result.Dispatched, previous)
+                    continue
+                }
+            }
+
+            // the new build is dispatched regardless; at worst the old one
+            // runs to completion
+            if cfg.CancelSuperseded {
+                err := self.stopDispatchedJobs(logEntry, cfg, target.JobId, pushEvent, supersededBy(pushEvent))
+                if err != nil {
+                    logEntry.Warnf("unable to stop superseded jobs for %s: %s", pushEvent.Ref, err)
+                }
+            }
+
+            meta := dispatchMeta(cfg, pushEvent, fieldMeta, target)
+
+            dispatched := dispatchResult{
+                Ref:        pushEvent.Ref,
+                JobId:      target.JobId,
+                Subproject: target.Subproject,
+            }
+
+            // actually dispatch the job to nomad
+            dispatchResp, _, err := self.nomad.Dispatch(
+                target.JobId,
+                meta,
+                dispatchBytes,
+                &nomadapi.WriteOptions{
+                    Namespace: cfg.Namespace,
+                    Region:    cfg.Region,
+                },
+            )
+
+            if err != nil {
+                logEntry.Errorf("unable to dispatch %s for %s: %s", target.JobId, pushEvent.Ref, err)
+
+                result.Failed = append(result.Failed, failedDispatch(pushEvent, target, err))
+                continue
+            }
+
+            logEntry.Infof("dispatched %s with eval %s for %s", dispatchResp.DispatchedJobID, dispatchResp.EvalID, pushEvent.Ref)
+
+            dispatched.DispatchedJobId = dispatchResp.DispatchedJobID
+            dispatched.EvalId = dispatchResp.EvalID
+            result.Dispatched = append(result.Dispatched, dispatched)
+
+            if deliveryKey != "" {
+                self.deliveries.recordDispatch(deliveryKey, key, dispatched)
+            }
+        }
+    }
+
+    // without replay protection, retrying will repeat the dispatches that
+    // succeeded
+    if len(result.Failed) > 0 {
+        writeJSON(resp, http.StatusServiceUnavailable, result)
+        return false
+    }
+
+    if len(result.Dispatched) == 0 && skippedByDirective > 0 {
+        resp.WriteHeader(http.StatusOK)
+        return true
+    }
+
+    if len(result.Dispatched) == 0 {
+        logEntry.Info("nothing to dispatch")
+        resp.WriteHeader(http.StatusNoContent)
+        return true
     }
 
-    logEntry.Infof(
-        "ping received for hook %d, %s, %s",
-        payload.Hook.ID,
-        *payload.Hook.Name,
-        *payload.Hook.URL,
-    )
+    writeJSON(resp, http.StatusAccepted, result)
 
-    resp.WriteHeader(http.StatusNoContent)
+    return true
 }
@@ -8,6 +8,9 @@ import (
 
     "github.com/stretchr/testify/mock"
 
+    "fmt"
+    "time"
+
     "encoding/json"
     "net/http"
     "net/http/httptest"
@@ -19,12 +22,40 @@ import (
     nomadapi "github.com/hashicorp/nomad/api"
     "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
     "github.com/nomad-ci/push-handler-service/internal/pkg/structs"
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
 )
 
 // actual payloads captured with requestb.in
 var githubPushEventExamplePayload string = `{"ref":"refs/heads/master","before":"0000000000000000000000000000000000000000","after":"024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7","created":true,"deleted":false,"forced":false,"base_ref":null,"compare":"https://github.com/nomad-ci/push-handler-service/compare/0b85e8064939^...024acfdef6b2","commits":[{"id":"0b85e806493942b8e30ee58b5b14de63c908cdd7","tree_id":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","distinct":true,"message":"repo create","timestamp":"2017-12-03T07:41:37-05:00","url":"https://github.com/nomad-ci/push-handler-service/commit/0b85e806493942b8e30ee58b5b14de63c908cdd7","author":{"name":"Brian Lalor","email":"blalor@bravo5.org","username":"blalor"},"committer":{"name":"Brian Lalor","email":"blalor@bravo5.org","username":"blalor"},"added":[],"removed":[],"modified":[]},{"id":"024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7","tree_id":"345b3baf64a2c3c059ff65c87236a1fd364ca7e6","distinct":true,"message":"dep init","timestamp":"2017-12-04T06:08:08-05:00","url":"https://github.com/nomad-ci/push-handler-service/commit/024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7","author":{"name":"Brian Lalor","email":"blalor@bravo5.org","username":"blalor"},"committer":{"name":"Brian Lalor","email":"blalor@bravo5.org","username":"blalor"},"added":["Gopkg.lock","Gopkg.toml"],"removed":[],"modified":[]}],"head_commit":{"id":"024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7","tree_id":"345b3baf64a2c3c059ff65c87236a1fd364ca7e6","distinct":true,"message":"dep init","timestamp":"2017-12-04T06:08:08-05:00","url":"https://github.com/nomad-ci/push-handler-service/commit/024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7","author":{"name":"Brian Lalor","email":"blalor@bravo5.org","username":"blalor"},"committer":{"name":"Brian Lalor","email":"blalor@bravo5.org","username":"blalor"},"added":["Gopkg.lock","Gopkg.toml"],"removed":[],"modified":[]},"repository":{"id":113032935,"name":"push-handler-service","full_name":"nomad-ci/push-handler-service","owner":{"name":"nomad-ci","email":null,"login":"nomad-ci","id":34209530,"avatar_url":"https://avatars1.githubusercontent.com/u/34209530?v=4","gravatar_id":"","url":"https://api.github.com/users/nomad-ci","html_url":"https://github.com/nomad-ci","followers_url":"https://api.github.com/users/nomad-ci/followers","following_url":"https://api.github.com/users/nomad-ci/following{/other_user}","gists_url":"https://api.github.com/users/nomad-ci/gists{/gist_id}","starred_url":"https://api.github.com/users/nomad-ci/starred{/owner}{/repo}","subscriptions_url":"https://api.github.com/users/nomad-ci/subscriptions","organizations_url":"https://api.github.com/users/nomad-ci/orgs","repos_url":"https://api.github.com/users/nomad-ci/repos","events_url":"https://api.github.com/users/nomad-ci/events{/privacy}","received_events_url":"https://api.github.com/users/nomad-ci/received_events","type":"Organization","site_admin":false},"private":false,"html_url":"https://github.com/nomad-ci/push-handler-service","description":null,"fork":false,"url":"https://github.com/nomad-ci/push-handler-service","forks_url":"https://api.github.com/repos/nomad-ci/push-handler-service/forks","keys_url":"https://api.github.com/repos/nomad-ci/push-handler-service/keys{/key_id}","collaborators_url":"https://api.github.com/repos/nomad-ci/push-handler-service/collaborators{/collaborator}","teams_url":"https://api.github.com/repos/nomad-ci/push-handler-service/teams","hooks_url":"https://api.github.com/repos/nomad-ci/push-handler-service/hooks","issue_events_url":"https://api.github.com/repos/nomad-ci/push-handler-service/issues/events{/number}","events_url":"https://api.github.com/repos/nomad-ci/push-handler-service/events","assignees_url":"https://api.github.com/repos/nomad-ci/push-handler-service/assignees{/user}","branches_url":"https://api.github.com/repos/nomad-ci/push-handler-service/branches{/branch}","tags_url":"https://api.github.com/repos/nomad-ci/push-handler-service/tags","blobs_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/blobs{/sha}","git_tags_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/tags{/sha}","git_refs_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/refs{/sha}","trees_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/trees{/sha}","statuses_url":"https://api.github.com/repos/nomad-ci/push-handler-service/statuses/{sha}","languages_url":"https://api.github.com/repos/nomad-ci/push-handler-service/languages","stargazers_url":"https://api.github.com/repos/nomad-ci/push-handler-service/stargazers","contributors_url":"https://api.github.com/repos/nomad-ci/push-handler-service/contributors","subscribers_url":"https://api.github.com/repos/nomad-ci/push-handler-service/subscribers","subscription_url":"https://api.github.com/repos/nomad-ci/push-handler-service/subscription","commits_url":"https://api.github.com/repos/nomad-ci/push-handler-service/commits{/sha}","git_commits_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/commits{/sha}","comments_url":"https://api.github.com/repos/nomad-ci/push-handler-service/comments{/number}","issue_comment_url":"https://api.github.com/repos/nomad-ci/push-handler-service/issues/comments{/number}","contents_url":"https://api.github.com/repos/nomad-ci/push-handler-service/contents/{+path}","compare_url":"https://api.github.com/repos/nomad-ci/push-handler-service/compare/{base}...{head}","merges_url":"https://api.github.com/repos/nomad-ci/push-handler-service/merges","archive_url":"https://api.github.com/repos/nomad-ci/push-handler-service/{archive_format}{/ref}","downloads_url":"https://api.github.com/repos/nomad-ci/push-handler-service/downloads","issues_url":"https://api.github.com/repos/nomad-ci/push-handler-service/issues{/number}","pulls_url":"https://api.github.com/repos/nomad-ci/push-handler-service/pulls{/number}","milestones_url":"https://api.github.com/repos/nomad-ci/push-handler-service/milestones{/number}","notifications_url":"https://api.github.com/repos/nomad-ci/push-handler-service/notifications{?since,all,participating}","labels_url":"https://api.github.com/repos/nomad-ci/push-handler-service/labels{/name}","releases_url":"https://api.github.com/repos/nomad-ci/push-handler-service/releases{/id}","deployments_url":"https://api.github.com/repos/nomad-ci/push-handler-service/deployments","created_at":1512386008,"updated_at":"2017-12-04T11:13:28Z","pushed_at":1512388275,"git_url":"git://github.com/nomad-ci/push-handler-service.git","ssh_url":"git@github.com:nomad-ci/push-handler-service.git","clone_url":"https://github.com/nomad-ci/push-handler-service.git","svn_url":"https://github.com/nomad-ci/push-handler-service","homepage":null,"size":0,"stargazers_count":0,"watchers_count":0,"language":null,"has_issues":true,"has_projects":true,"has_downloads":true,"has_wiki":true,"has_pages":false,"forks_count":0,"mirror_url":null,"archived":false,"open_issues_count":0,"license":null,"forks":0,"open_issues":0,"watchers":0,"default_branch":"master","stargazers":0,"master_branch":"master","organization":"nomad-ci"},"pusher":{"name":"blalor","email":"blalor@bravo5.org"},"organization":{"login":"nomad-ci","id":34209530,"url":"https://api.github.com/orgs/nomad-ci","repos_url":"https://api.github.com/orgs/nomad-ci/repos","events_url":"https://api.github.com/orgs/nomad-ci/events","hooks_url":"https://api.github.com/orgs/nomad-ci/hooks","issues_url":"https://api.github.com/orgs/nomad-ci/issues","members_url":"https://api.github.com/orgs/nomad-ci/members{/member}","public_members_url":"https://api.github.com/orgs/nomad-ci/public_members{/member}","avatar_url":"https://avatars1.githubusercontent.com/u/34209530?v=4","description":null},"sender":{"login":"blalor","id":109915,"avatar_url":"https://avatars0.githubusercontent.com/u/109915?v=4","gravatar_id":"","url":"https://api.github.com/users/blalor","html_url":"https://github.com/blalor","followers_url":"https://api.github.com/users/blalor/followers","following_url":"https://api.github.com/users/blalor/following{/other_user}","gists_url":"https://api.github.com/users/blalor/gists{/gist_id}","starred_url":"https://api.github.com/users/blalor/starred{/owner}{/repo}","subscriptions_url":"https://api.github.com/users/blalor/subscriptions","organizations_url":"https://api.github.com/users/blalor/orgs","repos_url":"https://api.github.com/users/blalor/repos","events_url":"https://api.github.com/users/blalor/events{/privacy}","received_events_url":"https://api.github.com/users/blalor/received_events","type":"User","site_admin":false}}`
 var githubWebhookPingExamplePayload string = `{"zen":"Favor focus over features.","hook_id":18642661,"hook":{"type":"Repository","id":18642661,"name":"web","active":true,"events":["push"],"config":{"content_type":"json","insecure_ssl":"0","secret":"********","url":"https://requestb.in/zedrkcze"},"updated_at":"2017-12-04T11:43:17Z","created_at":"2017-12-04T11:43:17Z","url":"https://api.github.com/repos/nomad-ci/push-handler-service/hooks/18642661","test_url":"https://api.github.com/repos/nomad-ci/push-handler-service/hooks/18642661/test","ping_url":"https://api.github.com/repos/nomad-ci/push-handler-service/hooks/18642661/pings","last_response":{"code":null,"status":"unused","message":null}},"repository":{"id":113032935,"name":"push-handler-service","full_name":"nomad-ci/push-handler-service","owner":{"login":"nomad-ci","id":34209530,"avatar_url":"https://avatars1.githubusercontent.com/u/34209530?v=4","gravatar_id":"","url":"https://api.github.com/users/nomad-ci","html_url":"https://github.com/nomad-ci","followers_url":"https://api.github.com/users/nomad-ci/followers","following_url":"https://api.github.com/users/nomad-ci/following{/other_user}","gists_url":"https://api.github.com/users/nomad-ci/gists{/gist_id}","starred_url":"https://api.github.com/users/nomad-ci/starred{/owner}{/repo}","subscriptions_url":"https://api.github.com/users/nomad-ci/subscriptions","organizations_url":"https://api.github.com/users/nomad-ci/orgs","repos_url":"https://api.github.com/users/nomad-ci/repos","events_url":"https://api.github.com/users/nomad-ci/events{/privacy}","received_events_url":"https://api.github.com/users/nomad-ci/received_events","type":"Organization","site_admin":false},"private":false,"html_url":"https://github.com/nomad-ci/push-handler-service","description":null,"fork":false,"url":"https://api.github.com/repos/nomad-ci/push-handler-service","forks_url":"https://api.github.com/repos/nomad-ci/push-handler-service/forks","keys_url":"https://api.github.com/repos/nomad-ci/push-handler-service/keys{/key_id}","collaborators_url":"https://api.github.com/repos/nomad-ci/push-handler-service/collaborators{/collaborator}","teams_url":"https://api.github.com/repos/nomad-ci/push-handler-service/teams","hooks_url":"https://api.github.com/repos/nomad-ci/push-handler-service/hooks","issue_events_url":"https://api.github.com/repos/nomad-ci/push-handler-service/issues/events{/number}","events_url":"https://api.github.com/repos/nomad-ci/push-handler-service/events","assignees_url":"https://api.github.com/repos/nomad-ci/push-handler-service/assignees{/user}","branches_url":"https://api.github.com/repos/nomad-ci/push-handler-service/branches{/branch}","tags_url":"https://api.github.com/repos/nomad-ci/push-handler-service/tags","blobs_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/blobs{/sha}","git_tags_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/tags{/sha}","git_refs_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/refs{/sha}","trees_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/trees{/sha}","statuses_url":"https://api.github.com/repos/nomad-ci/push-handler-service/statuses/{sha}","languages_url":"https://api.github.com/repos/nomad-ci/push-handler-service/languages","stargazers_url":"https://api.github.com/repos/nomad-ci/push-handler-service/stargazers","contributors_url":"https://api.github.com/repos/nomad-ci/push-handler-service/contributors","subscribers_url":"https://api.github.com/repos/nomad-ci/push-handler-service/subscribers","subscription_url":"https://api.github.com/repos/nomad-ci/push-handler-service/subscription","commits_url":"https://api.github.com/repos/nomad-ci/push-handler-service/commits{/sha}","git_commits_url":"https://api.github.com/repos/nomad-ci/push-handler-service/git/commits{/sha}","comments_url":"https://api.github.com/repos/nomad-ci/push-handler-service/comments{/number}","issue_comment_url":"https://api.github.com/repos/nomad-ci/push-handler-service/issues/comments{/number}","contents_url":"https://api.github.com/repos/nomad-ci/push-handler-service/contents/{+path}","compare_url":"https://api.github.com/repos/nomad-ci/push-handler-service/compare/{base}...{head}","merges_url":"https://api.github.com/repos/nomad-ci/push-handler-service/merges","archive_url":"https://api.github.com/repos/nomad-ci/push-handler-service/{archive_format}{/ref}","downloads_url":"https://api.github.com/repos/nomad-ci/push-handler-service/downloads","issues_url":"https://api.github.com/repos/nomad-ci/push-handler-service/issues{/number}","pulls_url":"https://api.github.com/repos/nomad-ci/push-handler-service/pulls{/number}","milestones_url":"https://api.github.com/repos/nomad-ci/push-handler-service/milestones{/number}","notifications_url":"https://api.github.com/repos/nomad-ci/push-handler-service/notifications{?since,all,participating}","labels_url":"https://api.github.com/repos/nomad-ci/push-handler-service/labels{/name}","releases_url":"https://api.github.com/repos/nomad-ci/push-handler-service/releases{/id}","deployments_url":"https://api.github.com/repos/nomad-ci/push-handler-service/deployments","created_at":"2017-12-04T11:13:28Z","updated_at":"2017-12-04T11:13:28Z","pushed_at":"2017-12-04T11:13:29Z","git_url":"git://github.com/nomad-ci/push-handler-service.git","ssh_url":"git@github.com:nomad-ci/push-handler-service.git","clone_url":"https://github.com/nomad-ci/push-handler-service.git","svn_url":"https://github.com/nomad-ci/push-handler-service","homepage":null,"size":0,"stargazers_count":0,"watchers_count":0,"language":null,"has_issues":true,"has_projects":true,"has_downloads":true,"has_wiki":true,"has_pages":false,"forks_count":0,"mirror_url":null,"archived":false,"open_issues_count":0,"license":null,"forks":0,"open_issues":0,"watchers":0,"default_branch":"master"},"sender":{"login":"blalor","id":109915,"avatar_url":"https://avatars0.githubusercontent.com/u/109915?v=4","gravatar_id":"","url":"https://api.github.com/users/blalor","html_url":"https://github.com/blalor","followers_url":"https://api.github.com/users/blalor/followers","following_url":"https://api.github.com/users/blalor/following{/other_user}","gists_url":"https://api.github.com/users/blalor/gists{/gist_id}","starred_url":"https://api.github.com/users/blalor/starred{/owner}{/repo}","subscriptions_url":"https://api.github.com/users/blalor/subscriptions","organizations_url":"https://api.github.com/users/blalor/orgs","repos_url":"https://api.github.com/users/blalor/repos","events_url":"https://api.github.com/users/blalor/events{/privacy}","received_events_url":"https://api.github.com/users/blalor/received_events","type":"User","site_admin":false}}`
 
+// a provider that trusts every request, identifies the event with a header and
+// takes the ref from the body
+type testProvider struct {}
+
+func (self *testProvider) Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error {
+    if req.Header.Get("X-Test-Auth") != "ok" {
+        return forge.NewRequestError("denied", http.StatusUnauthorized)
+    }
+
+    return nil
+}
+
+func (self *testProvider) EventType(req *http.Request, body []byte) forge.EventType {
+    if req.Header.Get("X-Test-Event") == "push" {
+        return forge.EventPush
+    }
+
+    return forge.EventUnsupported
+}
+
+func (self *testProvider) Normalize(eventType forge.EventType, body []byte) ([]*forge.PushEvent, error) {
+    var pushEvent forge.PushEvent
+    err := json.Unmarshal(body, &pushEvent)
+
+    return []*forge.PushEvent{&pushEvent}, err
+}
+
 var _ = Describe("PushHandler", func() {
     var ph *PushHandler
     var router *mux.Router
@@ -77,6 +108,7 @@ var _ = Describe("PushHandler", func() {
             req.Header.Add("X-Github-Event", "ping")
             req.Header.Add("X-Github-Delivery", "some-uuid")
             req.Header.Add("X-Hub-Signature", "sha1=d9fd3f2b1dd74386ece71aec95df0b442b1a8e61")
+            req.Header.Add("X-Hub-Signature-256", "sha256=b29d5436f6db8ad34447c856c5de678693a8c571649b739df7146ae71e8d6c40")
 
             router.ServeHTTP(resp, req)
             Expect(resp.Code).To(Equal(http.StatusNoContent))
@@ -113,6 +145,7 @@ var _ = Describe("PushHandler", func() {
             req.Header.Add("X-Github-Event", "push")
             req.Header.Add("X-Github-Delivery", "some-uuid")
             req.Header.Add("X-Hub-Signature", "sha1=93308d96ce42201626ede454a2b420cd21b9df71")
+            req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
 
             router.ServeHTTP(resp, req)
             Expect(resp.Code).To(Equal(http.StatusAccepted))
@@ -142,13 +175,216 @@ var _ = Describe("PushHandler", func() {
             req.Header.Add("Content-Type", "application/json")
             req.Header.Add("X-Github-Event", "push")
             req.Header.Add("X-Github-Delivery", "some-uuid")
-            req.Header.Add("X-Hub-Signature", "sha1=totallynotavalidsignature")
+            req.Header.Add("X-Hub-Signature-256", "sha256=0000000000000000000000000000000000000000000000000000000000000000")
 
             router.ServeHTTP(resp, req)
             Expect(resp.Code).To(Equal(http.StatusForbidden))
 
             mockVaultLogical.AssertExpectations(GinkgoT())
         })
+
+        It("should return 400 for a malformed signature", func() {
+            for _, signature := range []string{"sha", "sha256=", "sha256=nothex", "sha1=93308d96ce42201626ede454a2b420cd21b9df71"} {
+                resp = httptest.NewRecorder()
+
+                req, err := http.NewRequest(
+                    "POST",
+                    endpoint,
+                    strings.NewReader(githubPushEventExamplePayload),
+                )
+                Expect(err).ShouldNot(HaveOccurred())
+
+                req.Header.Add("Content-Type", "application/json")
+                req.Header.Add("X-Github-Event", "push")
+                req.Header.Add("X-Github-Delivery", "some-uuid")
+                req.Header.Add("X-Hub-Signature-256", signature)
+
+                router.ServeHTTP(resp, req)
+                Expect(resp.Code).To(Equal(http.StatusBadRequest), signature)
+            }
+
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+
+        It("should return 400 for a sha1 signature by default", func() {
+            req, err := http.NewRequest(
+                "POST",
+                endpoint,
+                strings.NewReader(githubPushEventExamplePayload),
+            )
+            Expect(err).ShouldNot(HaveOccurred())
+
+            req.Header.Add("Content-Type", "application/json")
+            req.Header.Add("X-Github-Event", "push")
+            req.Header.Add("X-Github-Delivery", "some-uuid")
+            req.Header.Add("X-Hub-Signature", "sha1=93308d96ce42201626ede454a2b420cd21b9df71")
+
+            router.ServeHTTP(resp, req)
+            Expect(resp.Code).To(Equal(http.StatusBadRequest))
+
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+
+        It("should acknowledge an unsupported event without dispatching", func() {
+            req, err := http.NewRequest(
+                "POST",
+                endpoint,
+                strings.NewReader(githubPushEventExamplePayload),
+            )
+            Expect(err).ShouldNot(HaveOccurred())
+
+            req.Header.Add("Content-Type", "application/json")
+            req.Header.Add("X-Github-Event", "watch")
+            req.Header.Add("X-Github-Delivery", "some-uuid")
+            req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
+
+            router.ServeHTTP(resp, req)
+            Expect(resp.Code).To(Equal(http.StatusOK))
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+    })
+
+    Describe("for GitHub with replay protection", func() {
+        endpoint := "http://example.com/notify/push/github/some-auth-token"
+
+        BeforeEach(func() {
+            ph.EnableReplayProtection(time.Hour)
+
+            mockVaultLogical.
+                On("Read", "webhook-tokens/github/some-auth-token").
+                Return(&vaultapi.Secret{
+                    Data: map[string]interface{} {
+                        "secret": "011746565c10e8c64df18d8724bc542da584433c",
+                    },
+                }, nil)
+        })
+
+        pushPayload := func(deliveryID, payload string) int {
+            resp = httptest.NewRecorder()
+
+            req, err := http.NewRequest("POST", endpoint, strings.NewReader(payload))
+            Expect(err).ShouldNot(HaveOccurred())
+
+            req.Header.Add("Content-Type", "application/json")
+            req.Header.Add("X-Github-Event", "push")
+            req.Header.Add("X-Github-Delivery", deliveryID)
+            req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("011746565c10e8c64df18d8724bc542da584433c", payload))
+
+            router.ServeHTTP(resp, req)
+
+            return resp.Code
+        }
+
+        push := func(deliveryID string) int {
+            return pushPayload(deliveryID, githubPushEventExamplePayload)
+        }
+
+        expectDispatch := func(err error) {
+            mockNomadJobs.
+                On(
+                    "Dispatch",
+                    dispatchJobId,
+                    map[string]string{},
+                    mock.AnythingOfType("[]uint8"),
+                    mock.AnythingOfType("*api.WriteOptions"),
+                ).
+                Return(
+                    &nomadapi.JobDispatchResponse{
+                        EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                        DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                    },
+                    &nomadapi.WriteMeta{},
+                    err,
+                ).
+                Once()
+        }
+
+        It("should not dispatch a redelivery", func() {
+            expectDispatch(nil)
+
+            Expect(push("some-uuid")).To(Equal(http.StatusAccepted))
+            Expect(push("some-uuid")).To(Equal(http.StatusOK))
+
+            Expect(mockNomadJobs.Calls).To(HaveLen(1))
+        })
+
+        It("should dispatch distinct deliveries", func() {
+            expectDispatch(nil)
+            expectDispatch(nil)
+
+            Expect(push("some-uuid")).To(Equal(http.StatusAccepted))
+            Expect(pushPayload("another-uuid", strings.Replace(githubPushEventExamplePayload, `"ref":"refs/heads/master"`, `"ref":"refs/heads/develop"`, 1))).To(Equal(http.StatusAccepted))
+
+            Expect(mockNomadJobs.Calls).To(HaveLen(2))
+        })
+
+        It("should not dispatch a replayed body with a new delivery id", func() {
+            expectDispatch(nil)
+
+            Expect(push("some-uuid")).To(Equal(http.StatusAccepted))
+            Expect(push("forged-uuid")).To(Equal(http.StatusOK))
+
+            Expect(mockNomadJobs.Calls).To(HaveLen(1))
+        })
+
+        It("should dispatch a retry of a failed delivery", func() {
+            expectDispatch(fmt.Errorf("nomad is down"))
+            expectDispatch(nil)
+
+            Expect(push("some-uuid")).To(Equal(http.StatusServiceUnavailable))
+            Expect(push("some-uuid")).To(Equal(http.StatusAccepted))
+
+            Expect(mockNomadJobs.Calls).To(HaveLen(2))
+        })
+    })
+
+    Describe("for GitHub webhooks allowing sha1", func() {
+        endpoint := "http://example.com/notify/push/github/sha1-auth-token"
+
+        BeforeEach(func() {
+            mockVaultLogical.
+                On("Read", "webhook-tokens/github/sha1-auth-token").
+                Return(&vaultapi.Secret{
+                    Data: map[string]interface{} {
+                        "secret":     "011746565c10e8c64df18d8724bc542da584433c",
+                        "allow_sha1": "true",
+                    },
+                }, nil)
+        })
+
+        newRequest := func(signature string) *http.Request {
+            req, err := http.NewRequest(
+                "POST",
+                endpoint,
+                strings.NewReader(githubWebhookPingExamplePayload),
+            )
+            Expect(err).ShouldNot(HaveOccurred())
+
+            req.Header.Add("Content-Type", "application/json")
+            req.Header.Add("X-Github-Event", "ping")
+            req.Header.Add("X-Github-Delivery", "some-uuid")
+            req.Header.Add("X-Hub-Signature", signature)
+
+            return req
+        }
+
+        It("should accept a sha1 signature", func() {
+            router.ServeHTTP(resp, newRequest("sha1=d9fd3f2b1dd74386ece71aec95df0b442b1a8e61"))
+            Expect(resp.Code).To(Equal(http.StatusNoContent))
+        })
+
+        It("should return 403 for an invalid sha1 signature", func() {
+            router.ServeHTTP(resp, newRequest("sha1=93308d96ce42201626ede454a2b420cd21b9df71"))
+            Expect(resp.Code).To(Equal(http.StatusForbidden))
+        })
+
+        It("should prefer the sha256 signature", func() {
+            req := newRequest("sha1=d9fd3f2b1dd74386ece71aec95df0b442b1a8e61")
+            req.Header.Add("X-Hub-Signature-256", "sha256=0000000000000000000000000000000000000000000000000000000000000000")
+
+            router.ServeHTTP(resp, req)
+            Expect(resp.Code).To(Equal(http.StatusForbidden))
+        })
     })
 
     Describe("for GitHub invalid webhooks", func() {
@@ -172,6 +408,7 @@ var _ = Describe("PushHandler", func() {
             req.Header.Add("X-Github-Event", "push")
             req.Header.Add("X-Github-Delivery", "some-uuid")
             req.Header.Add("X-Hub-Signature", "sha1=93308d96ce42201626ede454a2b420cd21b9df71")
+            req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
 
             router.ServeHTTP(resp, req)
             Expect(resp.Code).To(Equal(http.StatusNotFound))
@@ -180,4 +417,140 @@ var _ = Describe("PushHandler", func() {
         })
 
     })
+
+    Describe("when the webhook secret can't be used", func() {
+        newRequest := func() *http.Request {
+            req, err := http.NewRequest(
+                "POST",
+                "http://example.com/notify/push/github/some-auth-token",
+                strings.NewReader(githubPushEventExamplePayload),
+            )
+            Expect(err).ShouldNot(HaveOccurred())
+
+            req.Header.Add("Content-Type", "application/json")
+            req.Header.Add("X-Github-Event", "push")
+            req.Header.Add("X-Github-Delivery", "some-uuid")
+            req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
+
+            return req
+        }
+
+        It("should return 503 when Vault can't be read", func() {
+            mockVaultLogical.
+                On("Read", "webhook-tokens/github/some-auth-token").
+                Return(nil, fmt.Errorf("Code: 403. Errors: permission denied"))
+
+            router.ServeHTTP(resp, newRequest())
+            Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+            Expect(resp.Header().Get("Retry-After")).To(Equal("30"))
+
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+
+        It("should return 500 for a secret without webhook secrets", func() {
+            mockVaultLogical.
+                On("Read", "webhook-tokens/github/some-auth-token").
+                Return(&vaultapi.Secret{Data: map[string]interface{}{"dispatch_job_id": "other-job"}}, nil)
+
+            router.ServeHTTP(resp, newRequest())
+            Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+            Expect(resp.Header().Get("Retry-After")).To(BeEmpty())
+
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+
+        It("should return 500 for a secret that isn't a string", func() {
+            mockVaultLogical.
+                On("Read", "webhook-tokens/github/some-auth-token").
+                Return(&vaultapi.Secret{Data: map[string]interface{}{"secret": 1234}}, nil)
+
+            router.ServeHTTP(resp, newRequest())
+            Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+    })
+
+    Describe("for unknown providers", func() {
+        It("should return 404", func() {
+            req, err := http.NewRequest(
+                "POST",
+                "http://example.com/notify/push/sourceforge/some-auth-token",
+                strings.NewReader("{}"),
+            )
+            Expect(err).ShouldNot(HaveOccurred())
+
+            req.Header.Add("Content-Type", "application/json")
+
+            router.ServeHTTP(resp, req)
+            Expect(resp.Code).To(Equal(http.StatusNotFound))
+            Expect(mockVaultLogical.Calls).To(BeEmpty())
+        })
+    })
+
+    Describe("for a registered provider", func() {
+        endpoint := "http://example.com/notify/push/in-house/some-auth-token"
+
+        BeforeEach(func() {
+            ph.RegisterProvider("in-house", &testProvider{})
+
+            mockVaultLogical.
+                On("Read", "webhook-tokens/in-house/some-auth-token").
+                Return(&vaultapi.Secret{
+                    Data: map[string]interface{} {},
+                }, nil)
+        })
+
+        newRequest := func(auth string) *http.Request {
+            req, err := http.NewRequest(
+                "POST",
+                endpoint,
+                strings.NewReader(`{"CloneURL":"https://example.com/repo.git","Ref":"refs/heads/master","After":"024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7"}`),
+            )
+            Expect(err).ShouldNot(HaveOccurred())
+
+            req.Header.Add("Content-Type", "application/json")
+            req.Header.Add("X-Test-Event", "push")
+            req.Header.Add("X-Test-Auth", auth)
+
+            return req
+        }
+
+        It("should dispatch its push events", func() {
+            mockNomadJobs.
+                On(
+                    "Dispatch",
+                    dispatchJobId,
+                    map[string]string{},
+                    mock.AnythingOfType("[]uint8"),
+                    mock.AnythingOfType("*api.WriteOptions"),
+                ).
+                Return(
+                    &nomadapi.JobDispatchResponse{
+                        EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                        DispatchedJobID: dispatchJobId + "/dispatch-1234",
+                    },
+                    &nomadapi.WriteMeta{},
+                    nil,
+                )
+
+            router.ServeHTTP(resp, newRequest("ok"))
+            Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+            var dispatchPayload structs.CloneDispatchPayload
+            Expect(json.Unmarshal(mockNomadJobs.Calls[0].Arguments[2].([]byte), &dispatchPayload)).ShouldNot(HaveOccurred())
+
+            Expect(dispatchPayload).To(Equal(structs.CloneDispatchPayload{
+                CloneURL: "https://example.com/repo.git",
+                Ref:      "refs/heads/master",
+                SHA:      "024acfdef6b2f11d8b9b2d1e49b9dc401e64ffd7",
+            }))
+        })
+
+        It("should use the status from the provider's authentication error", func() {
+            router.ServeHTTP(resp, newRequest("nope"))
+            Expect(resp.Code).To(Equal(http.StatusUnauthorized))
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+    })
 })
@@ -0,0 +1,217 @@
+package push_handler
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "regexp"
+    "strings"
+
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// filters applied to push events before they're dispatched.  refs are matched
+// in full, like refs/heads/master; paths are relative to the repository root.
+// patterns are globs, where * and ? don't match "/" and ** matches any number
+// of path segments, unless prefixed with "regexp:".
+type Rules struct {
+    // if not empty, only refs matching one of these are dispatched
+    IncludeRefs []string `json:"include_refs"`
+
+    // refs matching any of these aren't dispatched
+    ExcludeRefs []string `json:"exclude_refs"`
+
+    // pushes that only change paths matching these aren't dispatched
+    IgnorePaths []string `json:"ignore_paths"`
+}
+
+// Rules with the patterns compiled
+type compiledRules struct {
+    includeRefs []*regexp.Regexp
+    excludeRefs []*regexp.Regexp
+    ignorePaths []*regexp.Regexp
+}
+
+// translates a glob into an anchored regular expression
+func globRegexp(glob string) string {
+    var expr bytes.Buffer
+    expr.WriteString("^")
+
+    for i := 0; i < len(glob); i++ {
+        switch {
+            case strings.HasPrefix(glob[i:], "**/"):
+                expr.WriteString("(.*/)?")
+                i += 2
+
+            case strings.HasPrefix(glob[i:], "**"):
+                expr.WriteString(".*")
+                i += 1
+
+            case glob[i] == '*':
+                expr.WriteString("[^/]*")
+
+            case glob[i] == '?':
+                expr.WriteString("[^/]")
+
+            default:
+                expr.WriteString(regexp.QuoteMeta(glob[i:i+1]))
+        }
+    }
+
+    expr.WriteString("$")
+
+    return expr.String()
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+    compiled := []*regexp.Regexp{}
+
+    for _, pattern := range patterns {
+        expr := globRegexp(pattern)
+        if strings.HasPrefix(pattern, "regexp:") {
+            expr = strings.TrimPrefix(pattern, "regexp:")
+        }
+
+        re, err := regexp.Compile(expr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+        }
+
+        compiled = append(compiled, re)
+    }
+
+    return compiled, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, str string) bool {
+    for _, re := range patterns {
+        if re.MatchString(str) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (self *Rules) compile() (*compiledRules, error) {
+    var err error
+
+    rules := &compiledRules{}
+
+    if rules.includeRefs, err = compilePatterns(self.IncludeRefs); err != nil {
+        return nil, fmt.Errorf("include_refs: %s", err)
+    }
+
+    if rules.excludeRefs, err = compilePatterns(self.ExcludeRefs); err != nil {
+        return nil, fmt.Errorf("exclude_refs: %s", err)
+    }
+
+    if rules.ignorePaths, err = compilePatterns(self.IgnorePaths); err != nil {
+        return nil, fmt.Errorf("ignore_paths: %s", err)
+    }
+
+    return rules, nil
+}
+
+// reads the default rules from a JSON file.  the rules are validated so that
+// mistakes are caught at startup.
+func ReadRulesFile(filename string) (*Rules, error) {
+    contents, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    rules := &Rules{}
+    if err := json.Unmarshal(contents, rules); err != nil {
+        return nil, fmt.Errorf("unable to parse %s: %s", filename, err)
+    }
+
+    if _, err := rules.compile(); err != nil {
+        return nil, fmt.Errorf("invalid rules in %s: %s", filename, err)
+    }
+
+    return rules, nil
+}
+
+// returns the rules for a token: the defaults, with any of include_refs,
+// exclude_refs, and ignore_paths set in the Vault secret replacing them
+func parseRules(secret *vaultapi.Secret, defaults Rules) (*compiledRules, error) {
+    rules := defaults
+
+    overrides := []struct {
+        key  string
+        list *[]string
+    }{
+        {"include_refs", &rules.IncludeRefs},
+        {"exclude_refs", &rules.ExcludeRefs},
+        {"ignore_paths", &rules.IgnorePaths},
+    }
+
+    for _, override := range overrides {
+        val, err := secretStringList(secret, override.key)
+        if err != nil {
+            return nil, err
+        }
+
+        if val != nil {
+            *override.list = val
+        }
+    }
+
+    return rules.compile()
+}
+
+// returns the paths changed by the commits, or nil if they aren't known
+func changedPaths(commits []*forge.Commit) []string {
+    if len(commits) == 0 {
+        return nil
+    }
+
+    paths := []string{}
+    for _, commit := range commits {
+        paths = append(paths, commit.Added...)
+        paths = append(paths, commit.Modified...)
+        paths = append(paths, commit.Removed...)
+    }
+
+    return paths
+}
+
+// returns why the push event shouldn't be dispatched, or "" if it should.
+// pull requests are filtered by the branch they'll be merged into.  path
+// rules only apply when the provider lists every commit in the push.
+func (self *compiledRules) skipReason(pushEvent *forge.PushEvent) string {
+    if self == nil {
+        return ""
+    }
+
+    ref := pushEvent.Ref
+    if pushEvent.PullRequest != nil {
+        ref = pushEvent.PullRequest.BaseRef
+    }
+
+    if len(self.includeRefs) > 0 && ! matchesAny(self.includeRefs, ref) {
+        return fmt.Sprintf("%s is not included", ref)
+    }
+
+    if matchesAny(self.excludeRefs, ref) {
+        return fmt.Sprintf("%s is excluded", ref)
+    }
+
+    paths := changedPaths(pushEvent.Commits)
+    if len(self.ignorePaths) == 0 || len(paths) == 0 {
+        return ""
+    }
+
+    for _, changed := range paths {
+        if ! matchesAny(self.ignorePaths, changed) {
+            return ""
+        }
+    }
+
+    return "only ignored paths changed"
+}
@@ -0,0 +1,222 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+// a push with a single commit; the ref, size, and the commit's modified files
+// are filled in
+var githubRulesPushEventPayload string = `{"ref":"%s","before":"6113728f27ae82c7b1a177c8d03f9e96e0adf246","after":"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",%s"commits":[{"id":"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c","message":"Update README.md","added":[],"removed":[],"modified":%s}],"repository":{"id":35129377,"name":"public-repo","full_name":"baxterthehacker/public-repo","clone_url":"https://github.com/baxterthehacker/public-repo.git"},"pusher":{"name":"baxterthehacker","email":"baxterthehacker@users.noreply.github.com"}}`
+
+var _ = Describe("dispatch rules", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            "clone-some-repo",
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                "clone-some-repo",
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: "clone-some-repo/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    withSecretData := func(data map[string]interface{}) {
+        data["secret"] = "s3kr1t"
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: data}, nil)
+    }
+
+    // size is only included when non-empty
+    push := func(ref, size, modified string) {
+        payload := fmt.Sprintf(githubRulesPushEventPayload, ref, size, modified)
+
+        req, err := http.NewRequest("POST", "http://example.com/notify/push/github/some-auth-token", strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("s3kr1t", payload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    expectDispatched := func(count int) {
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", count)
+    }
+
+    Describe("include_refs", func() {
+        BeforeEach(func() {
+            withSecretData(map[string]interface{} {
+                "include_refs": `["refs/heads/master", "refs/tags/v*"]`,
+            })
+        })
+
+        It("should dispatch included refs", func() {
+            push("refs/tags/v1.2.0", "", `["README.md"]`)
+            Expect(resp.Code).To(Equal(http.StatusAccepted))
+            expectDispatched(1)
+        })
+
+        It("should not dispatch other refs", func() {
+            push("refs/heads/feature", "", `["README.md"]`)
+            Expect(resp.Code).To(Equal(http.StatusNoContent))
+            expectDispatched(0)
+        })
+    })
+
+    It("should not dispatch excluded refs", func() {
+        withSecretData(map[string]interface{} {
+            "exclude_refs": []interface{}{"refs/heads/dependabot/**", `regexp:^refs/heads/wip-\d+$`},
+        })
+
+        push("refs/heads/dependabot/npm/lodash-4.17.21", "", `["package.json"]`)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        resp = httptest.NewRecorder()
+        push("refs/heads/wip-12", "", `["main.go"]`)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        expectDispatched(0)
+    })
+
+    Describe("ignore_paths", func() {
+        BeforeEach(func() {
+            withSecretData(map[string]interface{} {
+                "ignore_paths": `["docs/**", "**/*.md"]`,
+            })
+        })
+
+        It("should not dispatch pushes that only change ignored paths", func() {
+            push("refs/heads/master", "", `["README.md", "docs/guide/setup.txt", "cmd/README.md"]`)
+            Expect(resp.Code).To(Equal(http.StatusNoContent))
+            expectDispatched(0)
+        })
+
+        It("should dispatch pushes that change other paths", func() {
+            push("refs/heads/master", "", `["README.md", "main.go"]`)
+            Expect(resp.Code).To(Equal(http.StatusAccepted))
+            expectDispatched(1)
+        })
+
+        It("should dispatch pushes whose commits were truncated", func() {
+            push("refs/heads/master", `"size":25,`, `["README.md"]`)
+            Expect(resp.Code).To(Equal(http.StatusAccepted))
+            expectDispatched(1)
+        })
+    })
+
+    It("should let the token override the default rules", func() {
+        ph.SetDefaultRules(Rules{
+            IncludeRefs: []string{"refs/heads/master"},
+            IgnorePaths: []string{"**/*.md"},
+        })
+
+        withSecretData(map[string]interface{} {
+            "include_refs": []interface{}{"refs/heads/**"},
+        })
+
+        push("refs/heads/feature", "", `["main.go"]`)
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        resp = httptest.NewRecorder()
+        push("refs/heads/feature", "", `["README.md"]`)
+        Expect(resp.Code).To(Equal(http.StatusNoContent))
+
+        expectDispatched(1)
+    })
+
+    It("should return 500 for an invalid pattern", func() {
+        withSecretData(map[string]interface{} {
+            "exclude_refs": `["regexp:("]`,
+        })
+
+        push("refs/heads/master", "", `["main.go"]`)
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+        expectDispatched(0)
+    })
+
+    Describe("ReadRulesFile", func() {
+        var rulesFile *os.File
+
+        BeforeEach(func() {
+            var err error
+
+            rulesFile, err = ioutil.TempFile("", "rules")
+            Expect(err).ShouldNot(HaveOccurred())
+        })
+
+        AfterEach(func() {
+            os.Remove(rulesFile.Name())
+        })
+
+        It("should read the rules", func() {
+            fmt.Fprint(rulesFile, `{"exclude_refs": ["refs/heads/gh-pages"], "ignore_paths": ["docs/**"]}`)
+            rulesFile.Close()
+
+            rules, err := ReadRulesFile(rulesFile.Name())
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(*rules).To(Equal(Rules{
+                ExcludeRefs: []string{"refs/heads/gh-pages"},
+                IgnorePaths: []string{"docs/**"},
+            }))
+        })
+
+        It("should reject invalid patterns", func() {
+            fmt.Fprint(rulesFile, `{"include_refs": ["regexp:refs/heads/(master"]}`)
+            rulesFile.Close()
+
+            _, err := ReadRulesFile(rulesFile.Name())
+            Expect(err).Should(MatchError(ContainSubstring("include_refs")))
+        })
+    })
+})
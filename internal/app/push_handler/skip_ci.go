@@ -0,0 +1,59 @@
+package push_handler
+
+import (
+    "strings"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// commit message directives, like "[skip ci]", that suppress a build
+type skipDirectives struct {
+    tokens []string
+
+    // if set, a directive in any commit in the push counts, not just the head
+    allCommits bool
+}
+
+// suppresses dispatching pushes whose head commit message contains any of
+// the tokens, case-insensitively.  if allCommits is set every commit in the
+// push is checked.
+func (self *PushHandler) SetSkipDirectives(tokens []string, allCommits bool) {
+    self.skipDirectives = skipDirectives{
+        tokens:     tokens,
+        allCommits: allCommits,
+    }
+}
+
+// returns the first token found in the message, or ""
+func (self skipDirectives) find(message string) string {
+    message = strings.ToLower(message)
+
+    for _, token := range self.tokens {
+        if token != "" && strings.Contains(message, strings.ToLower(token)) {
+            return token
+        }
+    }
+
+    return ""
+}
+
+// returns the directive that suppresses the push event's build, or "" if it
+// should be built.  pull requests and deletions have no commit messages to
+// check.
+func (self skipDirectives) match(pushEvent *forge.PushEvent) string {
+    if pushEvent.HeadCommit != nil {
+        if token := self.find(pushEvent.HeadCommit.Message); token != "" {
+            return token
+        }
+    }
+
+    if self.allCommits {
+        for _, commit := range pushEvent.Commits {
+            if token := self.find(commit.Message); token != "" {
+                return token
+            }
+        }
+    }
+
+    return ""
+}
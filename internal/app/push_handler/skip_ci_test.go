@@ -0,0 +1,130 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+// a push of two commits; the commit messages are filled in, the head last
+var githubSkipCIPushEventPayload string = `{"ref":"refs/heads/master","before":"6113728f27ae82c7b1a177c8d03f9e96e0adf246","after":"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c","commits":[{"id":"1b7f2ce1d3a5f0e6a2b5a4f0f6b5b2a3c9e8d7f6","message":%q,"added":[],"removed":[],"modified":["README.md"]},{"id":"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c","message":%q,"added":[],"removed":[],"modified":["main.go"]}],"head_commit":{"id":"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c","message":%[2]q,"added":[],"removed":[],"modified":["main.go"]},"repository":{"id":35129377,"name":"public-repo","full_name":"baxterthehacker/public-repo","clone_url":"https://github.com/baxterthehacker/public-repo.git"},"pusher":{"name":"baxterthehacker","email":"baxterthehacker@users.noreply.github.com"}}`
+
+var _ = Describe("skip ci directives", func() {
+    var ph *PushHandler
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        ph = NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            "clone-some-repo",
+        )
+        ph.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        ph.SetSkipDirectives([]string{"[skip ci]", "[ci skip]", "***NO_CI***"}, false)
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{
+                Data: map[string]interface{} {
+                    "secret": "s3kr1t",
+                },
+            }, nil)
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                "clone-some-repo",
+                map[string]string{},
+                mock.AnythingOfType("[]uint8"),
+                mock.AnythingOfType("*api.WriteOptions"),
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: "clone-some-repo/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+    })
+
+    push := func(firstMessage, headMessage string) {
+        payload := fmt.Sprintf(githubSkipCIPushEventPayload, firstMessage, headMessage)
+
+        req, err := http.NewRequest("POST", "http://example.com/notify/push/github/some-auth-token", strings.NewReader(payload))
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256("s3kr1t", payload))
+
+        router.ServeHTTP(resp, req)
+    }
+
+    for _, message := range []string{"fix typo [skip ci]", "[CI SKIP] fix typo", "fix typo\n\n***NO_CI***"} {
+        message := message
+
+        It(fmt.Sprintf("should acknowledge without dispatching for %q", message), func() {
+            push("update docs", message)
+            Expect(resp.Code).To(Equal(http.StatusOK))
+
+            Expect(mockNomadJobs.Calls).To(BeEmpty())
+        })
+    }
+
+    It("should only check the head commit by default", func() {
+        push("update docs [skip ci]", "fix the build")
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 1)
+    })
+
+    It("should check every commit if configured to", func() {
+        ph.SetSkipDirectives([]string{"[skip ci]"}, true)
+
+        push("update docs [skip ci]", "fix the build")
+        Expect(resp.Code).To(Equal(http.StatusOK))
+
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+
+    It("should use the configured tokens", func() {
+        ph.SetSkipDirectives([]string{"[no build]"}, false)
+
+        push("update docs", "fix typo [skip ci]")
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        resp = httptest.NewRecorder()
+        push("update docs", "fix typo [no build]")
+        Expect(resp.Code).To(Equal(http.StatusOK))
+
+        mockNomadJobs.AssertNumberOfCalls(GinkgoT(), "Dispatch", 1)
+    })
+})
@@ -0,0 +1,239 @@
+package push_handler
+
+import (
+    "fmt"
+    "text/template"
+
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+// per-token settings, stored in Vault alongside the webhook secret.  unset
+// values fall back to the service's defaults.
+type webhookConfig struct {
+    // the parameterized job to dispatch
+    DispatchJobId string
+
+    // where the job is dispatched; empty for the Nomad client's defaults
+    Namespace string
+    Region    string
+
+    // static meta added to every dispatch
+    Meta map[string]string
+
+    // add the well-known push meta to every dispatch
+    PushMeta bool
+
+    // the schema of the dispatch payload
+    PayloadSchema string
+
+    // renders the dispatch payload instead of PayloadSchema, if set
+    PayloadTemplate *template.Template
+
+    // which of the repository's urls is dispatched, and an optional template
+    // that rewrites it
+    CloneURLSource   string
+    CloneURLTemplate *template.Template
+
+    // meta keys mapped to paths of values in the webhook payload
+    MetaFields map[string]fieldPath
+
+    // stop jobs still building a ref when a newer push for it is dispatched
+    CancelSuperseded bool
+
+    // filters applied before dispatching
+    Rules *compiledRules
+
+    // path prefixes mapped to the job to dispatch when they change, instead
+    // of DispatchJobId
+    FanOut map[string]string
+}
+
+// returns the string value of key in the secret, or "" if it isn't set
+func secretString(secret *vaultapi.Secret, key string) (string, error) {
+    val, ok := secret.Data[key]
+    if ! ok || val == nil {
+        return "", nil
+    }
+
+    str, ok := val.(string)
+    if ! ok {
+        return "", fmt.Errorf("%s is a %T, not a string", key, val)
+    }
+
+    return str, nil
+}
+
+// returns the map value of key in the secret, which may also be a
+// JSON-encoded string as written by `vault write`
+func secretStringMap(secret *vaultapi.Secret, key string) (map[string]string, error) {
+    val, ok := secret.Data[key]
+    if ! ok || val == nil {
+        return nil, nil
+    }
+
+    if str, ok := val.(string); ok {
+        if err := json.Unmarshal([]byte(str), &val); err != nil {
+            return nil, fmt.Errorf("unable to decode %s: %s", key, err)
+        }
+    }
+
+    entries, ok := val.(map[string]interface{})
+    if ! ok {
+        return nil, fmt.Errorf("%s is a %T, not a map", key, val)
+    }
+
+    result := map[string]string{}
+    for k, v := range entries {
+        str, ok := v.(string)
+        if ! ok {
+            return nil, fmt.Errorf("%s.%s is a %T, not a string", key, k, v)
+        }
+
+        result[k] = str
+    }
+
+    return result, nil
+}
+
+// returns the list value of key in the secret, which may also be a
+// JSON-encoded string as written by `vault write`.  returns nil if it isn't
+// set.
+func secretStringList(secret *vaultapi.Secret, key string) ([]string, error) {
+    val, ok := secret.Data[key]
+    if ! ok || val == nil {
+        return nil, nil
+    }
+
+    if str, ok := val.(string); ok {
+        if err := json.Unmarshal([]byte(str), &val); err != nil {
+            return nil, fmt.Errorf("unable to decode %s: %s", key, err)
+        }
+    }
+
+    entries, ok := val.([]interface{})
+    if ! ok {
+        return nil, fmt.Errorf("%s is a %T, not a list", key, val)
+    }
+
+    result := []string{}
+    for i, entry := range entries {
+        str, ok := entry.(string)
+        if ! ok {
+            return nil, fmt.Errorf("%s[%d] is a %T, not a string", key, i, entry)
+        }
+
+        result = append(result, str)
+    }
+
+    return result, nil
+}
+
+func (self *PushHandler) parseWebhookConfig(secret *vaultapi.Secret) (*webhookConfig, error) {
+    var err error
+
+    cfg := &webhookConfig{}
+
+    if cfg.DispatchJobId, err = secretString(secret, "dispatch_job_id"); err != nil {
+        return nil, err
+    }
+
+    if cfg.DispatchJobId == "" {
+        cfg.DispatchJobId = self.dispatchId
+    }
+
+    if cfg.Namespace, err = secretString(secret, "namespace"); err != nil {
+        return nil, err
+    }
+
+    if cfg.Region, err = secretString(secret, "region"); err != nil {
+        return nil, err
+    }
+
+    if cfg.Meta, err = secretStringMap(secret, "meta"); err != nil {
+        return nil, err
+    }
+
+    if cfg.PayloadSchema, err = secretString(secret, "payload_schema"); err != nil {
+        return nil, err
+    }
+
+    if cfg.PayloadSchema == "" {
+        cfg.PayloadSchema = self.payloadSchema
+    } else if err := validatePayloadSchema(cfg.PayloadSchema); err != nil {
+        return nil, err
+    }
+
+    payloadTemplate, err := secretString(secret, "payload_template")
+    if err != nil {
+        return nil, err
+    }
+
+    cfg.PayloadTemplate = self.payloadTemplate
+    if payloadTemplate != "" {
+        if cfg.PayloadTemplate, err = ParsePayloadTemplate("payload_template", payloadTemplate); err != nil {
+            return nil, err
+        }
+    }
+
+    if cfg.CloneURLSource, err = secretString(secret, "clone_url_source"); err != nil {
+        return nil, err
+    }
+
+    if cfg.CloneURLSource == "" {
+        cfg.CloneURLSource = CloneURLSourceHTTPS
+    } else if err := validateCloneURLSource(cfg.CloneURLSource); err != nil {
+        return nil, err
+    }
+
+    cloneURLTemplate, err := secretString(secret, "clone_url_template")
+    if err != nil {
+        return nil, err
+    }
+
+    if cloneURLTemplate != "" {
+        if cfg.CloneURLTemplate, err = ParseCloneURLTemplate("clone_url_template", cloneURLTemplate); err != nil {
+            return nil, err
+        }
+    }
+
+    cfg.PushMeta = self.pushMeta
+    if _, ok := secret.Data["push_meta"]; ok {
+        cfg.PushMeta = secretFlag(secret, "push_meta")
+    }
+
+    metaFields, err := secretStringMap(secret, "meta_fields")
+    if err != nil {
+        return nil, err
+    }
+
+    cfg.MetaFields = map[string]fieldPath{}
+    for key, expr := range metaFields {
+        if cfg.MetaFields[key], err = parseFieldPath(expr); err != nil {
+            return nil, fmt.Errorf("meta_fields.%s: %s", key, err)
+        }
+    }
+
+    cfg.CancelSuperseded = secretFlag(secret, "cancel_superseded")
+    if cfg.CancelSuperseded && ! cfg.findsDispatchedJobs() {
+        return nil, fmt.Errorf("cancel_superseded with a payload template requires push_meta")
+    }
+
+    if cfg.Rules, err = parseRules(secret, self.defaultRules); err != nil {
+        return nil, err
+    }
+
+    if cfg.FanOut, err = secretStringMap(secret, "fan_out"); err != nil {
+        return nil, err
+    }
+
+    return cfg, nil
+}
+
+// whether the jobs dispatched with this config can be found again to stop
+// them.  templated payloads aren't JSON, so those jobs can only be found by
+// their push meta.
+func (self *webhookConfig) findsDispatchedJobs() bool {
+    return self.PayloadTemplate == nil || self.PushMeta
+}
@@ -0,0 +1,108 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+var _ = Describe("per-token webhook config", func() {
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            "clone-some-repo",
+        ).InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+    })
+
+    withSecretData := func(data map[string]interface{}) {
+        data["secret"] = "011746565c10e8c64df18d8724bc542da584433c"
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(&vaultapi.Secret{Data: data}, nil)
+    }
+
+    push := func() {
+        req, err := http.NewRequest(
+            "POST",
+            "http://example.com/notify/push/github/some-auth-token",
+            strings.NewReader(githubPushEventExamplePayload),
+        )
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "push")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=3d10f65bb54c305a41dce13d7ea8f17556923473a119b6de7cc02bc11dd7417b")
+
+        router.ServeHTTP(resp, req)
+    }
+
+    It("should override the dispatch job, namespace, region and meta", func() {
+        withSecretData(map[string]interface{} {
+            "dispatch_job_id": "team-a-clone",
+            "namespace":       "team-a",
+            "region":          "east",
+            "meta":            `{"team": "a"}`,
+        })
+
+        mockNomadJobs.
+            On(
+                "Dispatch",
+                "team-a-clone",
+                map[string]string{"team": "a"},
+                mock.AnythingOfType("[]uint8"),
+                &nomadapi.WriteOptions{Namespace: "team-a", Region: "east"},
+            ).
+            Return(
+                &nomadapi.JobDispatchResponse{
+                    EvalID: "cafedead-beef-cafe-dead-beefcafedead",
+                    DispatchedJobID: "team-a-clone/dispatch-1234",
+                },
+                &nomadapi.WriteMeta{},
+                nil,
+            )
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusAccepted))
+
+        mockNomadJobs.AssertExpectations(GinkgoT())
+    })
+
+    It("should return 500 for malformed config", func() {
+        withSecretData(map[string]interface{} {
+            "meta": []interface{}{"not", "a", "map"},
+        })
+
+        push()
+        Expect(resp.Code).To(Equal(http.StatusInternalServerError))
+        Expect(mockNomadJobs.Calls).To(BeEmpty())
+    })
+})
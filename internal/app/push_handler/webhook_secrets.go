@@ -0,0 +1,33 @@
+package push_handler
+
+import (
+    "fmt"
+    "net/http"
+
+    vaultapi "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+)
+
+// true if the Vault secret configures any webhook secrets, expired or not
+func hasWebhookSecrets(secret *vaultapi.Secret) bool {
+    _, hasSecret := secret.Data["secret"]
+    _, hasSecrets := secret.Data["secrets"]
+
+    return hasSecret || hasSecrets
+}
+
+// retrieves the webhook secrets for a provider's Authenticate method.  a Vault
+// secret without any is a configuration mistake, not a bad request.
+func webhookSecretsForRequest(secret *vaultapi.Secret) ([]string, error) {
+    if ! hasWebhookSecrets(secret) {
+        return nil, newPreflightError("malformed webhook secret: no secret or secrets", http.StatusInternalServerError)
+    }
+
+    secrets, err := forge.WebhookSecrets(secret)
+    if err != nil {
+        return nil, newPreflightError(fmt.Sprintf("malformed webhook secret: %s", err), http.StatusInternalServerError)
+    }
+
+    return secrets, nil
+}
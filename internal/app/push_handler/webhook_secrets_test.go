@@ -0,0 +1,84 @@
+package push_handler_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+var _ = Describe("rotating GitHub webhook secrets", func() {
+    var router *mux.Router
+    var resp *httptest.ResponseRecorder
+
+    var mockVaultLogical interfaces.MockVaultLogical
+    var mockNomadJobs interfaces.MockNomadJobs
+
+    secretWithData := func(data map[string]interface{}) *vaultapi.Secret {
+        return &vaultapi.Secret{Data: data}
+    }
+
+    BeforeEach(func() {
+        router = mux.NewRouter()
+        resp = httptest.NewRecorder()
+
+        mockVaultLogical = interfaces.MockVaultLogical{}
+        mockNomadJobs = interfaces.MockNomadJobs{}
+
+        NewPushHandler(
+            &mockVaultLogical,
+            "webhook-tokens",
+            &mockNomadJobs,
+            "clone-some-repo",
+        ).InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+        mockVaultLogical.
+            On("Read", "webhook-tokens/github/some-auth-token").
+            Return(secretWithData(map[string]interface{} {
+                "secrets": []interface{}{
+                    map[string]interface{} {"secret": "new"},
+                    map[string]interface{} {"secret": "old",     "not_after": "2999-01-01T00:00:00Z"},
+                    map[string]interface{} {"secret": "expired", "not_after": "2000-01-01T00:00:00Z"},
+                },
+            }), nil)
+    })
+
+    ping := func(hmacSecret string) int {
+        req, err := http.NewRequest(
+            "POST",
+            "http://example.com/notify/push/github/some-auth-token",
+            strings.NewReader(githubWebhookPingExamplePayload),
+        )
+        Expect(err).ShouldNot(HaveOccurred())
+
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("X-Github-Event", "ping")
+        req.Header.Add("X-Github-Delivery", "some-uuid")
+        req.Header.Add("X-Hub-Signature-256", "sha256=" + hexMacSHA256(hmacSecret, githubWebhookPingExamplePayload))
+
+        router.ServeHTTP(resp, req)
+
+        return resp.Code
+    }
+
+    It("should accept the new secret", func() {
+        Expect(ping("new")).To(Equal(http.StatusNoContent))
+    })
+
+    It("should accept the old secret until it expires", func() {
+        Expect(ping("old")).To(Equal(http.StatusNoContent))
+    })
+
+    It("should reject an expired secret", func() {
+        Expect(ping("expired")).To(Equal(http.StatusForbidden))
+    })
+})
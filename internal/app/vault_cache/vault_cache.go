@@ -0,0 +1,318 @@
+package vault_cache
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "net/http"
+    "net/url"
+
+    "encoding/json"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/gorilla/mux"
+
+    "github.com/hashicorp/vault/api"
+
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+// a read-through cache in front of Vault, so that every webhook delivery
+// doesn't wait on a Vault round trip, and a brief Vault outage doesn't fail
+// deliveries for tokens that were recently used.  satisfies
+// interfaces.VaultLogicalWithData.
+type VaultCache struct {
+    vault interfaces.VaultLogical
+
+    // how long a secret is cached when Vault doesn't give it a lease
+    // duration, and the most any secret is cached, so rotated secrets are
+    // picked up
+    defaultTTL time.Duration
+    maxTTL     time.Duration
+
+    // how long a path with no secret is cached, so that repeated deliveries
+    // for a removed token don't each read from Vault
+    negativeTTL time.Duration
+
+    // limits concurrent reads of paths without a cached secret.  each guessed
+    // token is a different path that's never cached, so this is what keeps a
+    // flood of guesses from swamping Vault.  nil for no limit.
+    uncachedReads chan struct{}
+
+    // how long past its expiry a secret is still returned when Vault can't be
+    // read
+    maxStale time.Duration
+
+    // the most entries kept, however many paths are read
+    maxEntries int
+
+    // maps the prefixes given to the admin endpoint to the paths they're
+    // cached under; nil if they're the same
+    mapPrefix func(string) string
+
+    lock      sync.Mutex
+    entries   map[string]*cacheEntry
+    lastPrune time.Time
+}
+
+type cacheEntry struct {
+    // nil if there's no secret at the path
+    secret *api.Secret
+
+    expires time.Time
+}
+
+func NewVaultCache(vault interfaces.VaultLogical, defaultTTL, maxTTL time.Duration) *VaultCache {
+    return &VaultCache{
+        vault:      vault,
+        defaultTTL: defaultTTL,
+        maxTTL:     maxTTL,
+        maxEntries: defaultMaxEntries,
+        entries:    map[string]*cacheEntry{},
+    }
+}
+
+const defaultMaxEntries = 10000
+
+// returned instead of reading a path without a cached secret when too many
+// such reads are already waiting on Vault
+var ErrTooManyUncachedReads = errors.New("too many concurrent reads of uncached Vault secrets")
+
+// limits concurrent reads of paths without a cached secret; reads beyond the
+// limit fail with ErrTooManyUncachedReads.  0 removes the limit.
+func (self *VaultCache) SetMaxUncachedReads(maxReads int) {
+    self.uncachedReads = nil
+    if maxReads > 0 {
+        self.uncachedReads = make(chan struct{}, maxReads)
+    }
+}
+
+// limits the number of cached entries.  once full, missing secrets aren't
+// cached, and caching a secret evicts another entry.
+func (self *VaultCache) SetMaxEntries(maxEntries int) {
+    self.maxEntries = maxEntries
+}
+
+// maps the prefixes given to the admin endpoint to the paths they're cached
+// under, such as a KV v2 secret's data path
+func (self *VaultCache) SetPrefixMapper(mapPrefix func(string) string) {
+    self.mapPrefix = mapPrefix
+}
+
+// caches paths with no secret for ttl; 0 disables negative caching
+func (self *VaultCache) SetNegativeTTL(ttl time.Duration) {
+    self.negativeTTL = ttl
+}
+
+// returns expired secrets for up to maxStale when Vault returns an error; 0
+// disables serving stale secrets
+func (self *VaultCache) SetMaxStale(maxStale time.Duration) {
+    self.maxStale = maxStale
+}
+
+// how long to cache the result of a read
+func (self *VaultCache) ttl(secret *api.Secret) time.Duration {
+    if secret == nil {
+        return self.negativeTTL
+    }
+
+    ttl := self.defaultTTL
+    if secret.LeaseDuration > 0 {
+        ttl = time.Duration(secret.LeaseDuration) * time.Second
+    }
+
+    if self.maxTTL > 0 && ttl > self.maxTTL {
+        ttl = self.maxTTL
+    }
+
+    return ttl
+}
+
+func (self *VaultCache) lookup(key string) *cacheEntry {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.entries[key]
+}
+
+// returns the cached secret at path, reading it from Vault if it isn't cached
+// or has expired.  errors aren't cached.
+func (self *VaultCache) Read(path string) (*api.Secret, error) {
+    return self.read(path, func() (*api.Secret, error) {
+        return self.vault.Read(path)
+    })
+}
+
+// like Read, for reads with query parameters, such as the version of a KV v2
+// secret.  each combination of path and parameters is cached separately.
+func (self *VaultCache) ReadWithData(path string, data map[string][]string) (*api.Secret, error) {
+    vault, ok := self.vault.(interfaces.VaultLogicalWithData)
+    if ! ok {
+        return nil, fmt.Errorf("the Vault client can't send query parameters")
+    }
+
+    return self.read(path + "?" + url.Values(data).Encode(), func() (*api.Secret, error) {
+        return vault.ReadWithData(path, data)
+    })
+}
+
+// returns the secret cached under key, calling fetch if it isn't cached or has
+// expired
+func (self *VaultCache) read(key string, fetch func() (*api.Secret, error)) (*api.Secret, error) {
+    now := time.Now()
+
+    cached := self.lookup(key)
+    if cached != nil && now.Before(cached.expires) {
+        return cached.secret, nil
+    }
+
+    // paths with a secret are refreshed regardless, so known tokens keep
+    // working during a flood
+    if (cached == nil || cached.secret == nil) && self.uncachedReads != nil {
+        select {
+            case self.uncachedReads <- struct{}{}:
+                defer func() { <-self.uncachedReads }()
+
+            default:
+                return nil, ErrTooManyUncachedReads
+        }
+    }
+
+    secret, err := fetch()
+    if err != nil {
+        // only a secret that was found is worth serving stale; a stale "not
+        // found" would hide the outage for no benefit
+        if cached != nil && cached.secret != nil && now.Before(cached.expires.Add(self.maxStale)) {
+            log.Warnf("serving stale secret for %s: %s", key, err)
+            return cached.secret, nil
+        }
+
+        return nil, err
+    }
+
+    ttl := self.ttl(secret)
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    delete(self.entries, key)
+    self.prune(now)
+
+    if ttl > 0 && self.makeRoom(secret, now) {
+        self.entries[key] = &cacheEntry{
+            secret:  secret,
+            expires: now.Add(ttl),
+        }
+    }
+
+    return secret, nil
+}
+
+// true if the entry can no longer be served.  missing secrets are never
+// served stale, so they go as soon as they expire.
+func (self *VaultCache) expired(entry *cacheEntry, now time.Time) bool {
+    if entry.secret == nil {
+        return ! now.Before(entry.expires)
+    }
+
+    return now.After(entry.expires.Add(self.maxStale))
+}
+
+// removes entries that can no longer be served, at most once per minute.  must
+// be called with the lock held.
+func (self *VaultCache) prune(now time.Time) {
+    if now.Sub(self.lastPrune) < time.Minute {
+        return
+    }
+
+    self.lastPrune = now
+
+    for path, entry := range self.entries {
+        if self.expired(entry, now) {
+            delete(self.entries, path)
+        }
+    }
+}
+
+// true if there's room to cache secret, evicting another entry if the cache is
+// full and secret was found.  must be called with the lock held.
+func (self *VaultCache) makeRoom(secret *api.Secret, now time.Time) bool {
+    if self.maxEntries <= 0 || len(self.entries) < self.maxEntries {
+        return true
+    }
+
+    if secret == nil {
+        return false
+    }
+
+    // prune early rather than evict something that can still be served
+    self.lastPrune = time.Time{}
+    self.prune(now)
+
+    if len(self.entries) < self.maxEntries {
+        return true
+    }
+
+    // evict any entry, preferring one for a missing secret
+    var victim string
+    for path, entry := range self.entries {
+        victim = path
+        if entry.secret == nil {
+            break
+        }
+    }
+
+    delete(self.entries, victim)
+
+    return true
+}
+
+// removes cached entries whose paths start with prefix, or every entry if
+// prefix is empty, and returns how many were removed
+func (self *VaultCache) Invalidate(prefix string) int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    removed := 0
+    for path := range self.entries {
+        if strings.HasPrefix(path, prefix) {
+            delete(self.entries, path)
+            removed += 1
+        }
+    }
+
+    return removed
+}
+
+// the response to an invalidation request
+type invalidateResponse struct {
+    Invalidated int `json:"invalidated"`
+}
+
+// handles POST /invalidate, with an optional "prefix" query parameter
+func (self *VaultCache) HandleInvalidate(resp http.ResponseWriter, req *http.Request) {
+    prefix := req.URL.Query().Get("prefix")
+    if prefix != "" && self.mapPrefix != nil {
+        prefix = self.mapPrefix(prefix)
+    }
+
+    removed := self.Invalidate(prefix)
+    log.Infof("invalidated %d cached secrets with prefix %q", removed, prefix)
+
+    resp.Header().Set("Content-Type", "application/json")
+    resp.WriteHeader(http.StatusOK)
+
+    if err := json.NewEncoder(resp).Encode(invalidateResponse{removed}); err != nil {
+        log.Errorf("unable to write response: %s", err)
+    }
+}
+
+func (self *VaultCache) InstallHandlers(router *mux.Router) {
+    router.
+        Methods("POST").
+        Path("/invalidate").
+        HandlerFunc(self.HandleInvalidate)
+}
@@ -0,0 +1,316 @@
+package vault_cache_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/vault_cache"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/stretchr/testify/mock"
+
+    "fmt"
+    "time"
+
+    "net/http"
+    "net/http/httptest"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+)
+
+var _ = Describe("VaultCache", func() {
+    var cache *VaultCache
+    var mockVaultLogical interfaces.MockVaultLogical
+
+    secretPath := "webhook-tokens/github/some-auth-token"
+    secret := &vaultapi.Secret{
+        Data: map[string]interface{}{
+            "secret": "011746565c10e8c64df18d8724bc542da584433c",
+        },
+    }
+
+    BeforeEach(func() {
+        mockVaultLogical = interfaces.MockVaultLogical{}
+
+        cache = NewVaultCache(&mockVaultLogical, time.Minute, 0)
+    })
+
+    It("should cache secrets", func() {
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil)
+
+        for i := 0; i < 3; i++ {
+            cached, err := cache.Read(secretPath)
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(cached).To(Equal(secret))
+        }
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 1)
+    })
+
+    It("should read expired secrets again", func() {
+        cache = NewVaultCache(&mockVaultLogical, 20 * time.Millisecond, 0)
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil)
+
+        cache.Read(secretPath)
+        time.Sleep(30 * time.Millisecond)
+        cache.Read(secretPath)
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 2)
+    })
+
+    It("should honor the lease duration", func() {
+        cache = NewVaultCache(&mockVaultLogical, 10 * time.Millisecond, 0)
+        mockVaultLogical.On("Read", secretPath).Return(&vaultapi.Secret{LeaseDuration: 60}, nil)
+
+        cache.Read(secretPath)
+        time.Sleep(20 * time.Millisecond)
+        cache.Read(secretPath)
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 1)
+    })
+
+    It("should cap the lease duration", func() {
+        cache = NewVaultCache(&mockVaultLogical, time.Minute, 20 * time.Millisecond)
+        mockVaultLogical.On("Read", secretPath).Return(&vaultapi.Secret{LeaseDuration: 60}, nil)
+
+        cache.Read(secretPath)
+        time.Sleep(30 * time.Millisecond)
+        cache.Read(secretPath)
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 2)
+    })
+
+    It("should cache missing secrets with the negative ttl", func() {
+        cache.SetNegativeTTL(time.Minute)
+        mockVaultLogical.On("Read", secretPath).Return(nil, nil)
+
+        for i := 0; i < 3; i++ {
+            cached, err := cache.Read(secretPath)
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(cached).To(BeNil())
+        }
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 1)
+    })
+
+    It("should not cache missing secrets without a negative ttl", func() {
+        mockVaultLogical.On("Read", secretPath).Return(nil, nil)
+
+        cache.Read(secretPath)
+        cache.Read(secretPath)
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 2)
+    })
+
+    It("should not cache errors", func() {
+        mockVaultLogical.On("Read", secretPath).Return(nil, fmt.Errorf("connection refused")).Once()
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil).Once()
+
+        _, err := cache.Read(secretPath)
+        Expect(err).Should(MatchError("connection refused"))
+
+        cached, err := cache.Read(secretPath)
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(cached).To(Equal(secret))
+    })
+
+    It("should serve stale secrets when Vault fails", func() {
+        cache = NewVaultCache(&mockVaultLogical, 10 * time.Millisecond, 0)
+        cache.SetMaxStale(time.Minute)
+
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil).Once()
+        mockVaultLogical.On("Read", secretPath).Return(nil, fmt.Errorf("connection refused"))
+
+        cache.Read(secretPath)
+        time.Sleep(20 * time.Millisecond)
+
+        cached, err := cache.Read(secretPath)
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(cached).To(Equal(secret))
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 2)
+    })
+
+    It("should not serve secrets past the max staleness", func() {
+        cache = NewVaultCache(&mockVaultLogical, 10 * time.Millisecond, 0)
+        cache.SetMaxStale(10 * time.Millisecond)
+
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil).Once()
+        mockVaultLogical.On("Read", secretPath).Return(nil, fmt.Errorf("connection refused"))
+
+        cache.Read(secretPath)
+        time.Sleep(30 * time.Millisecond)
+
+        _, err := cache.Read(secretPath)
+        Expect(err).Should(MatchError("connection refused"))
+    })
+
+    It("should stop caching missing secrets once full", func() {
+        cache.SetNegativeTTL(time.Minute)
+        cache.SetMaxEntries(2)
+
+        paths := []string{"webhook-tokens/github/a", "webhook-tokens/github/b", "webhook-tokens/github/c"}
+        for _, path := range paths {
+            mockVaultLogical.On("Read", path).Return(nil, nil)
+        }
+
+        for i := 0; i < 2; i++ {
+            for _, path := range paths {
+                cache.Read(path)
+            }
+        }
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 4)
+        Expect(cache.Invalidate("")).To(Equal(2))
+    })
+
+    It("should evict missing secrets to cache found ones once full", func() {
+        cache.SetNegativeTTL(time.Minute)
+        cache.SetMaxEntries(1)
+
+        missingPath := "webhook-tokens/github/missing"
+        mockVaultLogical.On("Read", missingPath).Return(nil, nil)
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil)
+
+        cache.Read(missingPath)
+        cache.Read(secretPath)
+        cache.Read(secretPath)
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 2)
+        Expect(cache.Invalidate("")).To(Equal(1))
+    })
+
+    It("should limit concurrent reads of uncached paths", func() {
+        cache = NewVaultCache(&mockVaultLogical, 20 * time.Millisecond, 0)
+        cache.SetMaxUncachedReads(2)
+
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil)
+        cache.Read(secretPath)
+
+        started := make(chan bool)
+        release := make(chan bool)
+        for i := 0; i < 3; i++ {
+            mockVaultLogical.
+                On("Read", fmt.Sprintf("webhook-tokens/github/guess-%d", i)).
+                Return(nil, nil).
+                Run(func(_ mock.Arguments) {
+                    started <- true
+                    <-release
+                })
+        }
+
+        done := make(chan error)
+        for i := 0; i < 2; i++ {
+            go func(i int) {
+                _, err := cache.Read(fmt.Sprintf("webhook-tokens/github/guess-%d", i))
+                done <- err
+            }(i)
+
+            <-started
+        }
+
+        _, err := cache.Read("webhook-tokens/github/guess-2")
+        Expect(err).To(Equal(ErrTooManyUncachedReads))
+
+        // a known secret is still refreshed
+        time.Sleep(30 * time.Millisecond)
+        cached, err := cache.Read(secretPath)
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(cached).To(Equal(secret))
+
+        close(release)
+        Expect(<-done).ShouldNot(HaveOccurred())
+        Expect(<-done).ShouldNot(HaveOccurred())
+
+        go func() { <-started }()
+        _, err = cache.Read("webhook-tokens/github/guess-2")
+        Expect(err).ShouldNot(HaveOccurred())
+    })
+
+    It("should cache reads with different parameters separately", func() {
+        mockVersioned := interfaces.MockVaultLogicalWithData{}
+        cache = NewVaultCache(&mockVersioned, time.Minute, 0)
+
+        v1 := map[string][]string{"version": {"1"}}
+        v2 := map[string][]string{"version": {"2"}}
+
+        mockVersioned.On("ReadWithData", secretPath, v1).Return(secret, nil)
+        mockVersioned.On("ReadWithData", secretPath, v2).Return(nil, nil)
+
+        for i := 0; i < 2; i++ {
+            cached, err := cache.ReadWithData(secretPath, v1)
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(cached).To(Equal(secret))
+
+            cached, err = cache.ReadWithData(secretPath, v2)
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(cached).To(BeNil())
+        }
+
+        mockVersioned.AssertNumberOfCalls(GinkgoT(), "ReadWithData", 3)
+    })
+
+    It("should fail reads with parameters when Vault can't send them", func() {
+        _, err := cache.ReadWithData(secretPath, map[string][]string{"version": {"1"}})
+        Expect(err).Should(HaveOccurred())
+    })
+
+    It("should invalidate entries by prefix", func() {
+        otherPath := "webhook-tokens/gitlab/other-auth-token"
+
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil)
+        mockVaultLogical.On("Read", otherPath).Return(secret, nil)
+
+        cache.Read(secretPath)
+        cache.Read(otherPath)
+
+        Expect(cache.Invalidate("webhook-tokens/github/")).To(Equal(1))
+
+        cache.Read(secretPath)
+        cache.Read(otherPath)
+
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 3)
+    })
+
+    It("should invalidate everything from the admin endpoint", func() {
+        router := mux.NewRouter()
+        cache.InstallHandlers(router.PathPrefix("/admin/vault-cache").Subrouter())
+
+        mockVaultLogical.On("Read", secretPath).Return(secret, nil)
+        cache.Read(secretPath)
+
+        req, err := http.NewRequest("POST", "http://example.com/admin/vault-cache/invalidate", nil)
+        Expect(err).ShouldNot(HaveOccurred())
+
+        resp := httptest.NewRecorder()
+        router.ServeHTTP(resp, req)
+
+        Expect(resp.Code).To(Equal(http.StatusOK))
+        Expect(resp.Body.String()).To(MatchJSON(`{"invalidated": 1}`))
+
+        cache.Read(secretPath)
+        mockVaultLogical.AssertNumberOfCalls(GinkgoT(), "Read", 2)
+    })
+
+    It("should map prefixes from the admin endpoint", func() {
+        router := mux.NewRouter()
+        cache.InstallHandlers(router.PathPrefix("/admin/vault-cache").Subrouter())
+        cache.SetPrefixMapper(func(prefix string) string {
+            return "secret/data/" + prefix
+        })
+
+        dataPath := "secret/data/" + secretPath
+        mockVaultLogical.On("Read", dataPath).Return(secret, nil)
+        cache.Read(dataPath)
+
+        req, err := http.NewRequest("POST", "http://example.com/admin/vault-cache/invalidate?prefix=webhook-tokens/github/", nil)
+        Expect(err).ShouldNot(HaveOccurred())
+
+        resp := httptest.NewRecorder()
+        router.ServeHTTP(resp, req)
+
+        Expect(resp.Body.String()).To(MatchJSON(`{"invalidated": 1}`))
+    })
+})
@@ -0,0 +1,126 @@
+package vault_token
+
+import (
+    "fmt"
+    "io/ioutil"
+    "path"
+    "strings"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+// a way of obtaining a Vault token, used at startup and again whenever the
+// token can't be renewed any more
+type Authenticator interface {
+    // returns a secret whose Auth holds the new token
+    Login(client *vaultapi.Client) (*vaultapi.Secret, error)
+}
+
+// reads a file's contents, without surrounding whitespace
+func readCredential(filename string) (string, error) {
+    contents, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return "", err
+    }
+
+    credential := strings.TrimSpace(string(contents))
+    if credential == "" {
+        return "", fmt.Errorf("%s is empty", filename)
+    }
+
+    return credential, nil
+}
+
+// logs in to an auth method by writing to auth/<mount>/login
+func loginTo(client *vaultapi.Client, mount string, data map[string]interface{}) (*vaultapi.Secret, error) {
+    secret, err := client.Logical().Write(path.Join("auth", mount, "login"), data)
+    if err != nil {
+        return nil, err
+    }
+
+    if secret == nil || secret.Auth == nil {
+        return nil, fmt.Errorf("no auth info in response from auth/%s/login", mount)
+    }
+
+    return secret, nil
+}
+
+// reads the token from a file that something else keeps current, like a
+// Vault Agent sink.  the file is read again each time the token expires.
+type tokenFileAuth struct {
+    filename string
+}
+
+func NewTokenFileAuth(filename string) Authenticator {
+    return &tokenFileAuth{filename}
+}
+
+func (self *tokenFileAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+    token, err := readCredential(self.filename)
+    if err != nil {
+        return nil, err
+    }
+
+    return &vaultapi.Secret{
+        Auth: &vaultapi.SecretAuth{
+            ClientToken: token,
+        },
+    }, nil
+}
+
+// logs in with an AppRole role id, and a secret id read from a file so that
+// it can be delivered separately and rotated
+// https://developer.hashicorp.com/vault/docs/auth/approle
+type appRoleAuth struct {
+    mount        string
+    roleId       string
+    secretIdFile string
+}
+
+func NewAppRoleAuth(mount, roleId, secretIdFile string) Authenticator {
+    return &appRoleAuth{mount, roleId, secretIdFile}
+}
+
+func (self *appRoleAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+    data := map[string]interface{}{
+        "role_id": self.roleId,
+    }
+
+    // a role may be configured without a secret id
+    if self.secretIdFile != "" {
+        secretId, err := readCredential(self.secretIdFile)
+        if err != nil {
+            return nil, err
+        }
+
+        data["secret_id"] = secretId
+    }
+
+    return loginTo(client, self.mount, data)
+}
+
+// logs in with a JWT read from a file, like a Nomad workload identity or a
+// Kubernetes service account token.  the file is read on every login, since
+// the JWT is rotated.
+// https://developer.hashicorp.com/vault/docs/auth/jwt
+type jwtAuth struct {
+    mount   string
+    role    string
+    jwtFile string
+}
+
+func NewJWTAuth(mount, role, jwtFile string) Authenticator {
+    return &jwtAuth{mount, role, jwtFile}
+}
+
+func (self *jwtAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+    jwt, err := readCredential(self.jwtFile)
+    if err != nil {
+        return nil, err
+    }
+
+    return loginTo(client, self.mount, map[string]interface{}{
+        "role": self.role,
+        "jwt":  jwt,
+    })
+}
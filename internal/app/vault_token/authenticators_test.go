@@ -0,0 +1,141 @@
+package vault_token_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/vault_token"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "io/ioutil"
+    "time"
+    "os"
+    "path/filepath"
+
+    "net/http/httptest"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+var _ = Describe("authenticators", func() {
+    var vault *fakeVault
+    var server *httptest.Server
+    var client *vaultapi.Client
+    var watcher *TokenWatcher
+    var tmpDir string
+
+    BeforeEach(func() {
+        vault = &fakeVault{
+            ttl:             3600,
+            renewable:       true,
+            renewalsAllowed: -1,
+            loginToken:      "new-token",
+        }
+        server = httptest.NewServer(vault)
+
+        var err error
+        client, err = vaultapi.NewClient(&vaultapi.Config{Address: server.URL})
+        Expect(err).ShouldNot(HaveOccurred())
+
+        watcher = NewTokenWatcher(client)
+        watcher.SetRetryInterval(10 * time.Millisecond, 10 * time.Millisecond)
+
+        tmpDir, err = ioutil.TempDir("", "vault_token")
+        Expect(err).ShouldNot(HaveOccurred())
+    })
+
+    AfterEach(func() {
+        server.Close()
+        os.RemoveAll(tmpDir)
+    })
+
+    writeFile := func(name, contents string) string {
+        filename := filepath.Join(tmpDir, name)
+        Expect(ioutil.WriteFile(filename, []byte(contents), 0600)).ShouldNot(HaveOccurred())
+
+        return filename
+    }
+
+    It("should read the token from a file", func() {
+        watcher.SetAuthenticator(NewTokenFileAuth(writeFile("token", "sink-token\n")))
+
+        Expect(watcher.Login()).ShouldNot(HaveOccurred())
+        Expect(client.Token()).To(Equal("sink-token"))
+    })
+
+    It("should fail when the token file is empty", func() {
+        watcher.SetAuthenticator(NewTokenFileAuth(writeFile("token", "\n")))
+
+        Expect(watcher.Login()).Should(MatchError(ContainSubstring("is empty")))
+        Expect(watcher.Ready()).To(BeFalse())
+    })
+
+    It("should log in with AppRole", func() {
+        watcher.SetAuthenticator(NewAppRoleAuth("approle", "some-role-id", writeFile("secret-id", "some-secret-id")))
+
+        Expect(watcher.Login()).ShouldNot(HaveOccurred())
+        Expect(client.Token()).To(Equal("new-token"))
+
+        Expect(vault.loginBody).To(Equal(map[string]interface{}{
+            "role_id":   "some-role-id",
+            "secret_id": "some-secret-id",
+        }))
+    })
+
+    It("should log in with a JWT", func() {
+        watcher.SetAuthenticator(NewJWTAuth("jwt", "push-handler", writeFile("jwt", "eyJhbGciOiJSUzI1NiJ9.e30.c2ln")))
+
+        Expect(watcher.Login()).ShouldNot(HaveOccurred())
+        Expect(client.Token()).To(Equal("new-token"))
+
+        Expect(vault.loginBody).To(Equal(map[string]interface{}{
+            "role": "push-handler",
+            "jwt":  "eyJhbGciOiJSUzI1NiJ9.e30.c2ln",
+        }))
+    })
+
+    It("should log in again when the token can't be renewed", func() {
+        client.SetToken("old-token")
+        vault.unrenewableToken = "old-token"
+
+        watcher.SetAuthenticator(NewAppRoleAuth("approle", "some-role-id", ""))
+
+        go watcher.Run()
+
+        Eventually(client.Token).Should(Equal("new-token"))
+        Eventually(watcher.Ready).Should(BeTrue())
+    })
+
+    It("should log in again as soon as Vault refuses to renew the token", func() {
+        client.SetToken("old-token")
+        vault.deniedRenewalToken = "old-token"
+
+        watcher.SetAuthenticator(NewAppRoleAuth("approle", "some-role-id", ""))
+
+        go watcher.Run()
+
+        // the old token has an hour left, so this isn't waiting for it to expire
+        Eventually(client.Token).Should(Equal("new-token"))
+        Eventually(watcher.Ready).Should(BeTrue())
+    })
+
+    It("should not log in again when the token never expires", func() {
+        vault.ttl = 0
+        vault.renewable = false
+
+        watcher.SetAuthenticator(NewTokenFileAuth(writeFile("token", "sink-token")))
+        Expect(watcher.Login()).ShouldNot(HaveOccurred())
+
+        // a login would read the token again
+        Expect(ioutil.WriteFile(filepath.Join(tmpDir, "token"), []byte("new-token"), 0600)).ShouldNot(HaveOccurred())
+
+        done := make(chan struct{})
+        go func() {
+            watcher.Run()
+            close(done)
+        }()
+
+        Eventually(done).Should(BeClosed())
+        Consistently(client.Token, 50 * time.Millisecond).Should(Equal("sink-token"))
+        Expect(watcher.Ready()).To(BeTrue())
+    })
+})
@@ -0,0 +1,427 @@
+package vault_token
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "net/http"
+
+    "encoding/json"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+// renews the Vault client's token for as long as Vault allows, and reports the
+// token's state for health checks.  without renewal a periodic token expires
+// and every webhook fails to authenticate.
+type TokenWatcher struct {
+    client *vaultapi.Client
+
+    // logs in again when the token can't be renewed; nil for a static token
+    auth Authenticator
+
+    // how long to wait before retrying Vault, doubling up to the max
+    retryInterval    time.Duration
+    maxRetryInterval time.Duration
+
+    lock   sync.Mutex
+    status TokenStatus
+
+    // set once the token has been looked up
+    known bool
+}
+
+// the token's state, as reported by /health and /ready
+type TokenStatus struct {
+    // seconds until the token expires; 0 if it never does
+    TTL int `json:"ttl"`
+
+    ExpireTime  *time.Time `json:"expire_time,omitempty"`
+    Renewable   bool       `json:"renewable"`
+    LastRenewal *time.Time `json:"last_renewal,omitempty"`
+
+    // why the token can't be used or renewed any more
+    Error string `json:"error,omitempty"`
+
+    // why the last renewal failed, while the token is still usable and will
+    // be renewed again
+    RenewalError string `json:"renewal_error,omitempty"`
+}
+
+func NewTokenWatcher(client *vaultapi.Client) *TokenWatcher {
+    return &TokenWatcher{
+        client: client,
+
+        retryInterval:    defaultRetryInterval,
+        maxRetryInterval: defaultMaxRetryInterval,
+    }
+}
+
+// sets how long to wait before retrying Vault after a failed renewal, lookup,
+// or login; the wait doubles after each failure, up to max
+func (self *TokenWatcher) SetRetryInterval(interval, max time.Duration) {
+    self.retryInterval = interval
+    self.maxRetryInterval = max
+}
+
+// logs in with auth at startup and whenever the token can no longer be
+// renewed, instead of using the client's token until it expires
+func (self *TokenWatcher) SetAuthenticator(auth Authenticator) {
+    self.auth = auth
+}
+
+// records the token's remaining lifetime.  must be called with the lock held.
+func (self *TokenWatcher) setTTL(ttl time.Duration, renewable bool, now time.Time) {
+    self.known = true
+    self.status.Renewable = renewable
+    self.status.ExpireTime = nil
+    self.status.Error = ""
+    self.status.RenewalError = ""
+
+    if ttl > 0 {
+        expires := now.Add(ttl)
+        self.status.ExpireTime = &expires
+    }
+}
+
+func (self *TokenWatcher) lookedUp(ttl time.Duration, renewable bool, now time.Time) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.setTTL(ttl, renewable, now)
+}
+
+func (self *TokenWatcher) renewed(ttl time.Duration, now time.Time) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.setTTL(ttl, true, now)
+    self.status.LastRenewal = &now
+}
+
+func (self *TokenWatcher) failed(err error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.known = true
+    self.status.Renewable = false
+    self.status.Error = err.Error()
+}
+
+// records a failure to renew a token that's still usable
+func (self *TokenWatcher) renewalFailed(err error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.status.RenewalError = err.Error()
+}
+
+// how long the token has left; 0 if it's unknown, unusable, or expired
+func (self *TokenWatcher) remaining() time.Duration {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if ! self.known || self.status.Error != "" || self.status.ExpireTime == nil {
+        return 0
+    }
+
+    if remaining := self.status.ExpireTime.Sub(time.Now()); remaining > 0 {
+        return remaining
+    }
+
+    return 0
+}
+
+// returns the token's current state
+func (self *TokenWatcher) Status() TokenStatus {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    status := self.status
+    if status.ExpireTime != nil {
+        status.TTL = int(status.ExpireTime.Sub(time.Now()) / time.Second)
+        if status.TTL < 0 {
+            status.TTL = 0
+        }
+    }
+
+    return status
+}
+
+// true once the token is known to be usable and it hasn't expired or stopped
+// being renewable
+func (self *TokenWatcher) Ready() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if ! self.known || self.status.Error != "" {
+        return false
+    }
+
+    return self.status.ExpireTime == nil || time.Now().Before(*self.status.ExpireTime)
+}
+
+// logs in with the authenticator and gives the client the new token
+func (self *TokenWatcher) Login() error {
+    secret, err := self.auth.Login(self.client)
+    if err != nil {
+        self.failed(fmt.Errorf("unable to log in: %s", err))
+        return err
+    }
+
+    self.client.SetToken(secret.Auth.ClientToken)
+    log.Info("logged in to Vault")
+
+    return nil
+}
+
+// watches the token until it can't be renewed any more, then, if there's an
+// authenticator, logs in again, retrying with backoff until it succeeds.
+// blocks, so run it in a goroutine; returns if the token never expires.
+func (self *TokenWatcher) Run() {
+    var lastLogin time.Time
+
+    backoff := self.retryInterval
+    for {
+        started := time.Now()
+        result := self.watch()
+
+        // logging in again would only replace it with another such token
+        if result == tokenPermanent {
+            return
+        }
+
+        // start backing off afresh once a renewal has succeeded
+        if lastRenewal := self.Status().LastRenewal; lastRenewal != nil && lastRenewal.After(started) {
+            backoff = self.retryInterval
+        }
+
+        // Vault couldn't be reached; the token is still good, so keep trying
+        // to renew it.  a static token is retried even once it's expired, in
+        // case it's been renewed elsewhere.
+        if result == vaultUnavailable {
+            remaining := self.remaining()
+
+            if self.auth == nil || remaining > 0 {
+                wait := backoff
+                if self.auth != nil && wait > remaining {
+                    wait = remaining
+                }
+
+                log.Warnf("retrying Vault token renewal in %s", wait)
+                time.Sleep(wait)
+
+                if backoff *= 2; backoff > self.maxRetryInterval {
+                    backoff = self.maxRetryInterval
+                }
+
+                continue
+            }
+        }
+
+        backoff = self.retryInterval
+
+        if self.auth == nil {
+            return
+        }
+
+        // don't hammer Vault with logins if every new token is immediately
+        // unusable
+        if wait := self.retryInterval - time.Since(lastLogin); wait > 0 {
+            time.Sleep(wait)
+        }
+
+        for backoff := self.retryInterval; self.Login() != nil; backoff *= 2 {
+            if backoff > self.maxRetryInterval {
+                backoff = self.maxRetryInterval
+            }
+
+            log.Errorf("unable to log in to Vault; retrying in %s: %s", backoff, self.Status().Error)
+            time.Sleep(backoff)
+        }
+
+        lastLogin = time.Now()
+    }
+}
+
+const (
+    defaultRetryInterval    = 5 * time.Second
+    defaultMaxRetryInterval = 5 * time.Minute
+)
+
+// why watch stopped
+type watchResult int
+
+const (
+    // the token can't be renewed any more
+    renewalStopped watchResult = iota
+
+    // Vault couldn't be reached or failed to renew the token, which may
+    // still be renewable.  a token Vault rejected is unusable, not this.
+    vaultUnavailable
+
+    // the token never expires, so there's nothing more to do
+    tokenPermanent
+)
+
+// true if Vault refused the request itself, as it does for a revoked token or
+// one its policy no longer allows, rather than failing to handle it
+func isRejected(err error) bool {
+    respErr, ok := err.(*vaultapi.ResponseError)
+
+    return ok && respErr.StatusCode >= 400 && respErr.StatusCode < 500
+}
+
+// records that the token can't be used.  with an authenticator it's replaced
+// right away; a static token is retried in case it's fixed elsewhere.
+func (self *TokenWatcher) unusable(err error) watchResult {
+    self.failed(err)
+
+    if self.auth != nil {
+        return renewalStopped
+    }
+
+    return vaultUnavailable
+}
+
+// looks up the token and renews it until Vault won't renew it any more.  a
+// token that isn't renewable is watched until it's nearly expired, if there's
+// an authenticator to replace it.
+func (self *TokenWatcher) watch() watchResult {
+    lookup, err := self.client.Auth().Token().LookupSelf()
+    if err != nil {
+        log.Errorf("unable to look up Vault token: %s", err)
+
+        // a token we already know about is still good until it expires,
+        // unless Vault rejected it
+        if self.remaining() > 0 && ! isRejected(err) {
+            self.renewalFailed(fmt.Errorf("unable to look up token: %s", err))
+            return vaultUnavailable
+        }
+
+        return self.unusable(fmt.Errorf("unable to look up token: %s", err))
+    }
+
+    ttl, err := lookup.TokenTTL()
+    if err != nil {
+        self.failed(fmt.Errorf("unable to read token ttl: %s", err))
+        return renewalStopped
+    }
+
+    renewable, _ := lookup.TokenIsRenewable()
+    self.lookedUp(ttl, renewable, time.Now())
+
+    if ttl == 0 {
+        log.Info("Vault token never expires")
+        return tokenPermanent
+    }
+
+    if ! renewable {
+        log.Warnf("Vault token isn't renewable; it expires in %s", ttl)
+
+        // log in again with a third of its lifetime left, as the renewer would
+        if self.auth != nil {
+            time.Sleep(ttl * 2 / 3)
+        }
+
+        return renewalStopped
+    }
+
+    // the renewer needs the token's auth info, which only a renewal returns
+    auth, err := self.client.Auth().Token().RenewSelf(0)
+    if err == nil && (auth == nil || auth.Auth == nil) {
+        err = fmt.Errorf("no auth info in response")
+    }
+
+    if err != nil {
+        log.Errorf("unable to renew Vault token; it expires in %s: %s", ttl, err)
+
+        if isRejected(err) {
+            return self.unusable(fmt.Errorf("unable to renew token: %s", err))
+        }
+
+        self.renewalFailed(fmt.Errorf("unable to renew token: %s", err))
+        return vaultUnavailable
+    }
+
+    self.renewed(time.Duration(auth.Auth.LeaseDuration) * time.Second, time.Now())
+
+    renewer, err := self.client.NewRenewer(&vaultapi.RenewerInput{Secret: auth})
+    if err != nil {
+        self.failed(fmt.Errorf("unable to start renewing token: %s", err))
+        return renewalStopped
+    }
+
+    go renewer.Renew()
+    defer renewer.Stop()
+
+    for {
+        select {
+            case renewal := <-renewer.RenewCh():
+                ttl := time.Duration(renewal.Secret.Auth.LeaseDuration) * time.Second
+                self.renewed(ttl, renewal.RenewedAt)
+
+                log.Debugf("renewed Vault token; it expires in %s", ttl)
+
+            case err := <-renewer.DoneCh():
+                // the renewer gives up on any failed renewal, but only these
+                // mean the token can't be renewed again
+                if err != nil && err != vaultapi.ErrRenewerNotRenewable {
+                    log.Errorf("unable to renew Vault token; it expires in %ds: %s", self.Status().TTL, err)
+
+                    if isRejected(err) {
+                        return self.unusable(fmt.Errorf("unable to renew token: %s", err))
+                    }
+
+                    self.renewalFailed(fmt.Errorf("unable to renew token: %s", err))
+                    return vaultUnavailable
+                }
+
+                // a nil error means the token reached its max ttl
+                if err == nil {
+                    err = fmt.Errorf("token reached its maximum ttl")
+                }
+
+                log.Errorf("Vault token can no longer be renewed; it expires in %ds: %s", self.Status().TTL, err)
+                self.failed(fmt.Errorf("token can no longer be renewed: %s", err))
+                return renewalStopped
+        }
+    }
+}
+
+type healthResponse struct {
+    VaultToken TokenStatus `json:"vault_token"`
+}
+
+func (self *TokenWatcher) writeStatus(resp http.ResponseWriter, statusCode int) {
+    resp.Header().Set("Content-Type", "application/json")
+    resp.WriteHeader(statusCode)
+
+    if err := json.NewEncoder(resp).Encode(healthResponse{self.Status()}); err != nil {
+        log.Errorf("unable to write response: %s", err)
+    }
+}
+
+// always 200 while the service is up, with the token's state
+func (self *TokenWatcher) HandleHealth(resp http.ResponseWriter, req *http.Request) {
+    self.writeStatus(resp, http.StatusOK)
+}
+
+// 503 when webhooks can't be authenticated because the token is unusable
+func (self *TokenWatcher) HandleReady(resp http.ResponseWriter, req *http.Request) {
+    statusCode := http.StatusOK
+    if ! self.Ready() {
+        statusCode = http.StatusServiceUnavailable
+    }
+
+    self.writeStatus(resp, statusCode)
+}
+
+func (self *TokenWatcher) InstallHandlers(router *mux.Router) {
+    router.Methods("GET").Path("/health").HandlerFunc(self.HandleHealth)
+    router.Methods("GET").Path("/ready").HandlerFunc(self.HandleReady)
+}
@@ -0,0 +1,290 @@
+package vault_token_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/internal/app/vault_token"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "fmt"
+    "sync"
+    "time"
+
+    "net/http"
+    "net/http/httptest"
+
+    "encoding/json"
+
+    "github.com/gorilla/mux"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+// a Vault server that only knows about the client's own token
+type fakeVault struct {
+    lock sync.Mutex
+
+    ttl       int
+    renewable bool
+
+    // renewals after this many say the token can't be renewed again, as at
+    // its max ttl; -1 never does
+    renewalsAllowed int
+    renewals        int
+
+    // this many renewals fail before any succeed
+    failRenewals int
+
+    // renewals of this token always say it can't be renewed again
+    unrenewableToken string
+
+    // lookups and renewals of this token are refused, as for a revoked token
+    revokedToken string
+
+    // renewals of this token are refused, as when its policy no longer
+    // allows them
+    deniedRenewalToken string
+
+    // the token handed out by logins, and the body of the last login
+    loginToken string
+    loginBody  map[string]interface{}
+}
+
+func (self *fakeVault) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    resp.Header().Set("Content-Type", "application/json")
+
+    token := req.Header.Get("X-Vault-Token")
+
+    switch req.URL.Path {
+        case "/v1/auth/token/lookup-self", "/v1/auth/token/renew-self", "/v1/auth/token/renew":
+            denied := self.revokedToken != "" && token == self.revokedToken
+            if req.URL.Path != "/v1/auth/token/lookup-self" && self.deniedRenewalToken != "" && token == self.deniedRenewalToken {
+                denied = true
+            }
+
+            if denied {
+                resp.WriteHeader(http.StatusForbidden)
+                fmt.Fprint(resp, `{"errors": ["permission denied"]}`)
+                return
+            }
+    }
+
+    switch req.URL.Path {
+        case "/v1/auth/token/lookup-self":
+            json.NewEncoder(resp).Encode(map[string]interface{}{
+                "data": map[string]interface{}{
+                    "id":        "some-token",
+                    "ttl":       self.ttl,
+                    "renewable": self.renewable,
+                },
+            })
+
+        case "/v1/auth/approle/login", "/v1/auth/jwt/login":
+            self.loginBody = map[string]interface{}{}
+            json.NewDecoder(req.Body).Decode(&self.loginBody)
+
+            json.NewEncoder(resp).Encode(map[string]interface{}{
+                "auth": map[string]interface{}{
+                    "client_token":   self.loginToken,
+                    "lease_duration": self.ttl,
+                    "renewable":      self.renewable,
+                },
+            })
+
+        case "/v1/auth/token/renew-self", "/v1/auth/token/renew":
+            if self.failRenewals > 0 {
+                self.failRenewals -= 1
+
+                resp.WriteHeader(http.StatusInternalServerError)
+                fmt.Fprint(resp, `{"errors": ["internal error"]}`)
+                return
+            }
+
+            unrenewable := self.unrenewableToken != "" && token == self.unrenewableToken
+            if self.renewalsAllowed >= 0 && self.renewals >= self.renewalsAllowed {
+                unrenewable = true
+            }
+
+            self.renewals += 1
+
+            json.NewEncoder(resp).Encode(map[string]interface{}{
+                "auth": map[string]interface{}{
+                    "client_token":   token,
+                    "lease_duration": self.ttl,
+                    "renewable":      self.renewable && ! unrenewable,
+                },
+            })
+
+        default:
+            resp.WriteHeader(http.StatusNotFound)
+    }
+}
+
+var _ = Describe("TokenWatcher", func() {
+    var vault *fakeVault
+    var server *httptest.Server
+    var watcher *TokenWatcher
+    var router *mux.Router
+
+    BeforeEach(func() {
+        vault = &fakeVault{
+            ttl:             3600,
+            renewable:       true,
+            renewalsAllowed: -1,
+        }
+        server = httptest.NewServer(vault)
+
+        client, err := vaultapi.NewClient(&vaultapi.Config{Address: server.URL})
+        Expect(err).ShouldNot(HaveOccurred())
+        client.SetToken("some-token")
+
+        watcher = NewTokenWatcher(client)
+        watcher.SetRetryInterval(10 * time.Millisecond, 10 * time.Millisecond)
+
+        router = mux.NewRouter()
+        watcher.InstallHandlers(router)
+    })
+
+    AfterEach(func() {
+        server.Close()
+    })
+
+    get := func(path string) (int, map[string]interface{}) {
+        req, err := http.NewRequest("GET", "http://example.com" + path, nil)
+        Expect(err).ShouldNot(HaveOccurred())
+
+        resp := httptest.NewRecorder()
+        router.ServeHTTP(resp, req)
+
+        var body map[string]interface{}
+        Expect(json.Unmarshal(resp.Body.Bytes(), &body)).ShouldNot(HaveOccurred())
+
+        return resp.Code, body["vault_token"].(map[string]interface{})
+    }
+
+    It("should not be ready before the token is looked up", func() {
+        code, _ := get("/ready")
+        Expect(code).To(Equal(http.StatusServiceUnavailable))
+    })
+
+    It("should renew a renewable token", func() {
+        go watcher.Run()
+
+        Eventually(func() *time.Time { return watcher.Status().LastRenewal }).ShouldNot(BeNil())
+        Expect(watcher.Ready()).To(BeTrue())
+
+        code, status := get("/health")
+        Expect(code).To(Equal(http.StatusOK))
+        Expect(status["ttl"]).To(BeNumerically("~", 3600, 5))
+        Expect(status["renewable"]).To(BeTrue())
+        Expect(status).To(HaveKey("last_renewal"))
+
+        code, _ = get("/ready")
+        Expect(code).To(Equal(http.StatusOK))
+    })
+
+    It("should be ready with a token that never expires", func() {
+        vault.ttl = 0
+        vault.renewable = false
+
+        watcher.Run()
+        Expect(watcher.Ready()).To(BeTrue())
+
+        _, status := get("/health")
+        Expect(status["ttl"]).To(BeNumerically("==", 0))
+        Expect(status).ToNot(HaveKey("expire_time"))
+    })
+
+    It("should be ready with a token that isn't renewable until it expires", func() {
+        vault.renewable = false
+
+        watcher.Run()
+        Expect(watcher.Ready()).To(BeTrue())
+
+        _, status := get("/health")
+        Expect(status["ttl"]).To(BeNumerically("~", 3600, 5))
+        Expect(status["renewable"]).To(BeFalse())
+    })
+
+    It("should not be ready once the token can't be renewed", func() {
+        vault.renewalsAllowed = 1
+
+        done := make(chan struct{})
+        go func() {
+            watcher.Run()
+            close(done)
+        }()
+
+        Eventually(done, 5 * time.Second).Should(BeClosed())
+        Expect(watcher.Ready()).To(BeFalse())
+
+        code, status := get("/ready")
+        Expect(code).To(Equal(http.StatusServiceUnavailable))
+        Expect(status["error"]).To(ContainSubstring("can no longer be renewed"))
+        Expect(status["ttl"]).To(BeNumerically("~", 3600, 5))
+    })
+
+    It("should keep renewing after a renewal fails", func() {
+        vault.failRenewals = 1
+
+        go watcher.Run()
+
+        Eventually(func() *time.Time { return watcher.Status().LastRenewal }).ShouldNot(BeNil())
+        Expect(watcher.Ready()).To(BeTrue())
+
+        _, status := get("/health")
+        Expect(status).ToNot(HaveKey("error"))
+        Expect(status).ToNot(HaveKey("renewal_error"))
+    })
+
+    It("should stay ready while Vault can't renew a token that hasn't expired", func() {
+        vault.failRenewals = 1000
+        watcher.SetRetryInterval(time.Minute, time.Minute)
+
+        go watcher.Run()
+
+        Eventually(func() string { return watcher.Status().RenewalError }).ShouldNot(BeEmpty())
+        Expect(watcher.Ready()).To(BeTrue())
+    })
+
+    It("should not be ready once Vault refuses to renew the token", func() {
+        vault.deniedRenewalToken = "some-token"
+        watcher.SetRetryInterval(time.Minute, time.Minute)
+
+        go watcher.Run()
+
+        Eventually(func() string { return watcher.Status().Error }).Should(ContainSubstring("permission denied"))
+        Expect(watcher.Ready()).To(BeFalse())
+    })
+
+    It("should be ready again once a revoked static token is accepted", func() {
+        vault.revokedToken = "some-token"
+
+        go watcher.Run()
+
+        Eventually(func() string { return watcher.Status().Error }).Should(ContainSubstring("permission denied"))
+        Expect(watcher.Ready()).To(BeFalse())
+
+        vault.lock.Lock()
+        vault.revokedToken = ""
+        vault.lock.Unlock()
+
+        Eventually(watcher.Ready).Should(BeTrue())
+    })
+
+    It("should not be ready when the token can't be looked up", func() {
+        server.Close()
+        watcher.SetRetryInterval(time.Minute, time.Minute)
+
+        go watcher.Run()
+        Eventually(func() string { return watcher.Status().Error }).ShouldNot(BeEmpty())
+        Expect(watcher.Ready()).To(BeFalse())
+
+        code, status := get("/ready")
+        Expect(code).To(Equal(http.StatusServiceUnavailable))
+        Expect(status["error"]).To(ContainSubstring("unable to look up token"))
+    })
+})
@@ -7,4 +7,13 @@ import (
 type NomadJobs interface {
     // dispatches a parameterized job
     Dispatch(jobID string, meta map[string]string, payload []byte, q *api.WriteOptions) (*api.JobDispatchResponse, *api.WriteMeta, error)
+
+    // lists jobs, optionally filtered by q.Prefix
+    List(q *api.QueryOptions) ([]*api.JobListStub, *api.QueryMeta, error)
+
+    // retrieves a job, including the payload of a dispatched job
+    Info(jobID string, q *api.QueryOptions) (*api.Job, *api.QueryMeta, error)
+
+    // stops a job, and removes it entirely if purge is true
+    Deregister(jobID string, purge bool, q *api.WriteOptions) (string, *api.WriteMeta, error)
 }
@@ -7,3 +7,11 @@ import (
 type VaultLogical interface {
     Read(path string) (*api.Secret, error)
 }
+
+// a VaultLogical that can also send query parameters, which reading a specific
+// version of a KV v2 secret requires
+type VaultLogicalWithData interface {
+    VaultLogical
+
+    ReadWithData(path string, data map[string][]string) (*api.Secret, error)
+}
@@ -5,3 +5,62 @@ type CloneDispatchPayload struct {
     Ref      string `json:"ref"`
     SHA      string `json:"sha"`
 }
+
+// dispatched for pull requests.  clone_url, ref and sha identify the head of
+// the pull request, which may be in a fork; the merge ref is in the base
+// repository.
+type PullRequestDispatchPayload struct {
+    CloneDispatchPayload
+
+    PullRequest  int    `json:"pull_request"`
+    BaseRef      string `json:"base_ref"`
+    BaseCloneURL string `json:"base_clone_url"`
+    MergeRef     string `json:"merge_ref"`
+}
+
+// the version of DispatchPayload.  fields may be added without changing it;
+// it's incremented when existing fields change.
+const DispatchPayloadSchemaVersion = 1
+
+// the versioned dispatch payload, describing the push in full
+type DispatchPayload struct {
+    SchemaVersion int `json:"schema_version"`
+
+    Provider   string `json:"provider"`
+    Event      string `json:"event"`
+    DeliveryID string `json:"delivery_id,omitempty"`
+
+    Repository DispatchRepository `json:"repository"`
+
+    Ref    string `json:"ref"`
+    Before string `json:"before,omitempty"`
+    After  string `json:"after"`
+
+    // null when the provider doesn't list every commit
+    Commits []DispatchCommit `json:"commits"`
+
+    Pusher string `json:"pusher,omitempty"`
+
+    // only for pull requests
+    PullRequest *DispatchPullRequest `json:"pull_request,omitempty"`
+}
+
+type DispatchRepository struct {
+    FullName string `json:"full_name,omitempty"`
+    CloneURL string `json:"clone_url"`
+}
+
+type DispatchCommit struct {
+    ID       string   `json:"id"`
+    Message  string   `json:"message"`
+    Added    []string `json:"added"`
+    Modified []string `json:"modified"`
+    Removed  []string `json:"removed"`
+}
+
+type DispatchPullRequest struct {
+    Number       int    `json:"number"`
+    BaseRef      string `json:"base_ref"`
+    BaseCloneURL string `json:"base_clone_url"`
+    MergeRef     string `json:"merge_ref"`
+}
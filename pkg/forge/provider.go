@@ -0,0 +1,73 @@
+// the API for adding providers: adapters from a forge's webhooks to the push
+// events that are dispatched as builds.  providers are registered with
+// service.Main, or PushHandler.RegisterProvider.
+package forge
+
+import (
+    "net/http"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+// the kind of event delivered by a webhook, independent of the provider
+type EventType string
+
+const (
+    // events the provider doesn't know how to handle; they're acknowledged
+    // but not dispatched
+    EventUnsupported EventType = ""
+
+    // the provider is checking that the webhook is reachable
+    EventPing EventType = "ping"
+
+    // one or more refs were updated
+    EventPush EventType = "push"
+
+    // a pull request was opened or its head changed
+    EventPullRequest EventType = "pull_request"
+)
+
+// a Provider adapts one forge's webhooks to the common push flow.  the push
+// handler looks up the Vault secret for the auth token and reads the body; the
+// Provider authenticates the request, identifies the event, and extracts the
+// refs to build.
+type Provider interface {
+    // verifies the request was sent by the forge, using the Vault secret for
+    // the webhook's auth token.  use NewRequestError to control the response
+    // status; any other error results in a 403.
+    Authenticate(req *http.Request, body []byte, secret *vaultapi.Secret) error
+
+    // identifies the event delivered by the request
+    EventType(req *http.Request, body []byte) EventType
+
+    // converts the body of a supported event into zero or more push events.
+    // an error results in a 400.
+    Normalize(eventType EventType, body []byte) ([]*PushEvent, error)
+}
+
+// optionally implemented by providers whose deliveries carry a unique id that
+// is preserved when the delivery is retried, like github's X-GitHub-Delivery.
+// used to ignore redeliveries.
+type DeliveryIdentifier interface {
+    // returns the delivery's id, or "" if it doesn't have one
+    DeliveryID(req *http.Request, body []byte) string
+}
+
+// an error that sets the response status when a provider rejects a request
+type RequestError struct {
+    msg        string
+    statusCode int
+}
+
+// lets providers control the response status when a request is rejected
+func NewRequestError(msg string, statusCode int) error {
+    return &RequestError{msg: msg, statusCode: statusCode}
+}
+
+func (self *RequestError) Error() string {
+    return self.msg
+}
+
+func (self *RequestError) StatusCode() int {
+    return self.statusCode
+}
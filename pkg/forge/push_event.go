@@ -0,0 +1,66 @@
+package forge
+
+// a single ref update, normalized from a provider's webhook payload
+type PushEvent struct {
+    // name the provider is registered under, like "github"
+    Provider string
+
+    // the kind of event, like "push" or "pull_request"
+    Event string
+
+    // the provider's id for the webhook delivery, if it has one
+    DeliveryID string
+
+    // the repository's name on the provider, like "octocat/Hello-World"
+    RepoFullName string
+
+    // who pushed, in the provider's terms
+    Pusher string
+
+    CloneURL string
+    Ref      string
+    Before   string
+    After    string
+
+    // the repository's other clone urls, when the provider sends them.  SSHURL
+    // is like git@github.com:octocat/Hello-World.git; GitURL uses git://.
+    SSHURL string
+    GitURL string
+
+    // set when the ref was deleted; After is empty or all zeros
+    Deleted bool
+
+    // the commits pushed, oldest first.  nil when the provider doesn't list
+    // them, or the list it sent is incomplete.
+    Commits []*Commit
+
+    // the commit the ref now points to, when the provider includes it
+    HeadCommit *Commit
+
+    // set when the event is for a pull request rather than a push
+    PullRequest *PullRequest
+}
+
+type Commit struct {
+    ID      string
+    Message string
+
+    // paths changed by the commit
+    Added    []string
+    Modified []string
+    Removed  []string
+}
+
+type PullRequest struct {
+    Number int
+
+    // the branch the pull request will be merged into, and its repository
+    BaseRef      string
+    BaseCloneURL string
+    BaseSSHURL   string
+    BaseGitURL   string
+
+    // the ref in the base repository for the result of merging the pull
+    // request, like refs/pull/1/merge
+    MergeRef string
+}
@@ -0,0 +1,83 @@
+package forge
+
+import (
+    "fmt"
+    "time"
+
+    "encoding/json"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+// returns the secrets a webhook's deliveries may be authenticated with.  a
+// single secret is stored as "secret".  to rotate without an outage window the
+// Vault secret can instead hold a list of secrets, each optionally with an
+// RFC 3339 expiry:
+//
+//     {"secrets": ["new", "old"]}
+//     {"secrets": [{"secret": "new"}, {"secret": "old", "not_after": "2017-12-31T00:00:00Z"}]}
+//
+// the list may also be a JSON-encoded string, as written by `vault write`.
+// expired entries are omitted.
+func WebhookSecrets(secret *vaultapi.Secret) ([]string, error) {
+    secrets := []string{}
+    now := time.Now()
+
+    if val, ok := secret.Data["secret"]; ok {
+        str, ok := val.(string)
+        if ! ok {
+            return nil, fmt.Errorf("secret is a %T, not a string", val)
+        }
+
+        secrets = append(secrets, str)
+    }
+
+    val, ok := secret.Data["secrets"]
+    if ! ok {
+        return secrets, nil
+    }
+
+    if str, ok := val.(string); ok {
+        if err := json.Unmarshal([]byte(str), &val); err != nil {
+            return nil, fmt.Errorf("unable to decode secrets: %s", err)
+        }
+    }
+
+    entries, ok := val.([]interface{})
+    if ! ok {
+        return nil, fmt.Errorf("secrets is a %T, not a list", val)
+    }
+
+    for i, entry := range entries {
+        switch entry := entry.(type) {
+            case string:
+                secrets = append(secrets, entry)
+
+            case map[string]interface{}:
+                str, ok := entry["secret"].(string)
+                if ! ok {
+                    return nil, fmt.Errorf("secrets[%d] has no secret", i)
+                }
+
+                if notAfter, ok := entry["not_after"]; ok {
+                    notAfterStr, _ := notAfter.(string)
+
+                    expiry, err := time.Parse(time.RFC3339, notAfterStr)
+                    if err != nil {
+                        return nil, fmt.Errorf("secrets[%d] has an invalid not_after: %v", i, notAfter)
+                    }
+
+                    if now.After(expiry) {
+                        continue
+                    }
+                }
+
+                secrets = append(secrets, str)
+
+            default:
+                return nil, fmt.Errorf("secrets[%d] is a %T", i, entry)
+        }
+    }
+
+    return secrets, nil
+}
@@ -0,0 +1,57 @@
+package forge_test
+
+import (
+    . "github.com/nomad-ci/push-handler-service/pkg/forge"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    vaultapi "github.com/hashicorp/vault/api"
+)
+
+var _ = Describe("WebhookSecrets", func() {
+    secretWithData := func(data map[string]interface{}) *vaultapi.Secret {
+        return &vaultapi.Secret{Data: data}
+    }
+
+    It("should return a single secret", func() {
+        Expect(WebhookSecrets(secretWithData(map[string]interface{} {
+            "secret": "only",
+        }))).To(Equal([]string{"only"}))
+    })
+
+    It("should return a list of secrets", func() {
+        Expect(WebhookSecrets(secretWithData(map[string]interface{} {
+            "secrets": []interface{}{"new", "old"},
+        }))).To(Equal([]string{"new", "old"}))
+    })
+
+    It("should decode a list written as a string", func() {
+        Expect(WebhookSecrets(secretWithData(map[string]interface{} {
+            "secrets": `["new", "old"]`,
+        }))).To(Equal([]string{"new", "old"}))
+    })
+
+    It("should omit expired secrets", func() {
+        Expect(WebhookSecrets(secretWithData(map[string]interface{} {
+            "secrets": []interface{}{
+                map[string]interface{} {"secret": "new"},
+                map[string]interface{} {"secret": "old",     "not_after": "2999-01-01T00:00:00Z"},
+                map[string]interface{} {"secret": "expired", "not_after": "2000-01-01T00:00:00Z"},
+            },
+        }))).To(Equal([]string{"new", "old"}))
+    })
+
+    It("should reject malformed secrets", func() {
+        for _, data := range []map[string]interface{} {
+            {"secret": 42},
+            {"secrets": "not json"},
+            {"secrets": []interface{}{42}},
+            {"secrets": []interface{}{map[string]interface{} {"not_after": "2999-01-01T00:00:00Z"}}},
+            {"secrets": []interface{}{map[string]interface{} {"secret": "new", "not_after": "tomorrow"}}},
+        } {
+            _, err := WebhookSecrets(secretWithData(data))
+            Expect(err).To(HaveOccurred(), "%v", data)
+        }
+    })
+})
@@ -0,0 +1,323 @@
+// the push handler service, as run by cmd/push-handler-service.  embed it to
+// run the service with providers of your own:
+//
+//     func main() {
+//         service.Main(version, map[string]forge.Provider{
+//             "our-forge": &ourForgeProvider{},
+//         })
+//     }
+package service
+
+import (
+    "os"
+    "fmt"
+    "syscall"
+    "time"
+    "net/http"
+    "strings"
+
+    "crypto/subtle"
+
+    flags "github.com/jessevdk/go-flags"
+    log "github.com/Sirupsen/logrus"
+
+    "github.com/nomad-ci/push-handler-service/internal/app/push_handler"
+    "github.com/nomad-ci/push-handler-service/internal/app/vault_cache"
+    "github.com/nomad-ci/push-handler-service/internal/app/vault_token"
+    "github.com/nomad-ci/push-handler-service/internal/pkg/interfaces"
+    "github.com/nomad-ci/push-handler-service/pkg/forge"
+
+    vaultapi "github.com/hashicorp/vault/api"
+    nomadapi "github.com/hashicorp/nomad/api"
+
+    "github.com/gorilla/mux"
+)
+
+type Options struct {
+    Debug      bool   `env:"DEBUG"     long:"debug"    description:"enable debug"`
+    LogFile    string `env:"LOG_FILE"  long:"log-file" description:"path to JSON log file"`
+
+    HttpPort   int    `env:"HTTP_PORT" long:"port"     description:"port to accept requests on" default:"8080"`
+
+    VaultAddr  string `env:"VAULT_ADDR"  long:"vault-addr"  description:"address of the Vault server"     required:"true"`
+    VaultToken string `env:"VAULT_TOKEN" long:"vault-token" description:"auth token for this application"`
+
+    VaultTokenFile string `env:"VAULT_TOKEN_FILE" long:"vault-token-file" description:"file with the Vault token, like a Vault Agent sink; read again when the token expires"`
+
+    VaultAppRoleMount        string `env:"VAULT_APPROLE_MOUNT"          long:"vault-approle-mount"          description:"path of the AppRole auth method" default:"approle"`
+    VaultAppRoleRoleId       string `env:"VAULT_APPROLE_ROLE_ID"        long:"vault-approle-role-id"        description:"AppRole role id to log in to Vault with"`
+    VaultAppRoleSecretIdFile string `env:"VAULT_APPROLE_SECRET_ID_FILE" long:"vault-approle-secret-id-file" description:"file with the AppRole secret id"`
+
+    VaultJWTMount string `env:"VAULT_JWT_MOUNT" long:"vault-jwt-mount" description:"path of the JWT auth method" default:"jwt"`
+    VaultJWTRole  string `env:"VAULT_JWT_ROLE"  long:"vault-jwt-role"  description:"role to log in to Vault with a JWT, like a Nomad workload identity"`
+    VaultJWTFile  string `env:"VAULT_JWT_FILE"  long:"vault-jwt-file"  description:"file with the JWT"`
+
+    VaultCacheTTL         time.Duration `env:"VAULT_CACHE_TTL"          long:"vault-cache-ttl"          description:"how long to cache webhook secrets without a lease duration; 0 disables the cache" default:"1m"`
+    VaultCacheMaxTTL      time.Duration `env:"VAULT_CACHE_MAX_TTL"      long:"vault-cache-max-ttl"      description:"the most a webhook secret is cached, whatever its lease duration"               default:"10m"`
+    VaultCacheNegativeTTL time.Duration `env:"VAULT_CACHE_NEGATIVE_TTL" long:"vault-cache-negative-ttl" description:"how long to cache unknown webhook tokens"                                       default:"10s"`
+    VaultCacheMaxStale    time.Duration `env:"VAULT_CACHE_MAX_STALE"    long:"vault-cache-max-stale"    description:"how long past expiry a cached secret is used when Vault can't be read"          default:"1h"`
+    VaultCacheMaxEntries  int           `env:"VAULT_CACHE_MAX_ENTRIES"  long:"vault-cache-max-entries"  description:"the most webhook secrets and unknown tokens cached"                              default:"10000"`
+    VaultCacheMaxUncached int           `env:"VAULT_CACHE_MAX_UNCACHED" long:"vault-cache-max-uncached" description:"the most concurrent Vault reads of uncached tokens; 0 for no limit"               default:"16"`
+
+    AdminToken string `env:"ADMIN_TOKEN" long:"admin-token" description:"bearer token for the /admin endpoints, which are disabled without it"`
+
+    NomadAddr  string `env:"NOMAD_ADDR"  long:"nomad-addr"  description:"address of the Nomad server"     required:"true"`
+    // NomadToken string `env:"NOMAD_TOKEN" long:"nomad-token" description:"auth token for this application" required:"true"`
+
+    WebhookTokenPrefix string `env:"WEBHOOK_TOKEN_PREFIX" long:"webhook-token-prefix" description:"path root in vault to webhook tokens" required:"true"`
+
+    WebhookTokenKVVersion string `env:"WEBHOOK_TOKEN_KV_VERSION" long:"webhook-token-kv-version" description:"KV secrets engine version at the webhook token prefix: auto, 1, or 2" default:"auto"`
+    WebhookTokenKVMount   string `env:"WEBHOOK_TOKEN_KV_MOUNT"   long:"webhook-token-kv-mount"   description:"mount path of the KV v2 secrets engine with --webhook-token-kv-version 2; defaults to the prefix's first segment"`
+
+    DispatchJobId string `env:"DISPATCH_JOB_ID" long:"dispatch-job-id" description:"nomad job id for dispatching push events" required:"true"`
+
+    DeliveryWindow time.Duration `env:"DELIVERY_WINDOW" long:"delivery-window" description:"ignore redeliveries of a webhook within this window; 0 disables" default:"24h"`
+
+    PayloadSchema string `env:"PAYLOAD_SCHEMA" long:"payload-schema" description:"dispatch payload schema, legacy or v1" default:"legacy"`
+
+    PayloadTemplate string `env:"PAYLOAD_TEMPLATE" long:"payload-template" description:"Go text/template file to render dispatch payloads with, instead of JSON"`
+
+    PushMeta bool `env:"PUSH_META" long:"push-meta" description:"add push details like ref and sha to dispatch meta; the job must allow the keys"`
+
+    RulesFile string `env:"RULES_FILE" long:"rules-file" description:"JSON file with the default ref and path rules"`
+
+    SkipCITokens []string `env:"SKIP_CI_TOKENS" env-delim:"," long:"skip-ci-token" description:"don't dispatch pushes whose head commit message contains this; may be repeated" default:"[skip ci]" default:"[ci skip]" default:"***NO_CI***"`
+    SkipCIAnyCommit bool `env:"SKIP_CI_ANY_COMMIT" long:"skip-ci-any-commit" description:"check every commit in a push for skip-ci tokens, not just the head"`
+}
+
+func Log(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        log.Infof("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// rejects requests without the admin token as a bearer token
+func RequireAdminToken(token string, handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        auth := r.Header.Get("Authorization")
+        bearer := strings.TrimPrefix(auth, "Bearer ")
+
+        if bearer == auth || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// returns the mount and KV version webhook secrets are stored in, detecting
+// them if the version is "auto"
+func webhookTokenKV(vault interfaces.VaultLogical, opts Options) (string, int, error) {
+    switch opts.WebhookTokenKVVersion {
+        case "auto":
+            // guessing wrong would make every webhook look like an unknown
+            // token
+            mount, version, err := push_handler.DetectKVMount(vault, opts.WebhookTokenPrefix)
+            if err != nil {
+                return "", 0, fmt.Errorf("unable to detect the KV version at %s; set --webhook-token-kv-version: %s", opts.WebhookTokenPrefix, err)
+            }
+
+            return mount, version, nil
+
+        case "1":
+            return "", 1, nil
+
+        case "2":
+            mount := opts.WebhookTokenKVMount
+            if mount == "" {
+                mount = strings.SplitN(strings.Trim(opts.WebhookTokenPrefix, "/"), "/", 2)[0]
+            }
+
+            return mount, 2, nil
+    }
+
+    return "", 0, fmt.Errorf("unknown KV version %q", opts.WebhookTokenKVVersion)
+}
+
+// returns how to log in to Vault, or nil for a static --vault-token.  exactly
+// one way must be configured.
+func vaultAuthenticator(opts Options) (vault_token.Authenticator, error) {
+    var auth vault_token.Authenticator
+    configured := 0
+
+    if opts.VaultToken != "" {
+        configured += 1
+    }
+
+    if opts.VaultTokenFile != "" {
+        auth = vault_token.NewTokenFileAuth(opts.VaultTokenFile)
+        configured += 1
+    }
+
+    if opts.VaultAppRoleRoleId != "" {
+        auth = vault_token.NewAppRoleAuth(opts.VaultAppRoleMount, opts.VaultAppRoleRoleId, opts.VaultAppRoleSecretIdFile)
+        configured += 1
+    }
+
+    if opts.VaultJWTRole != "" || opts.VaultJWTFile != "" {
+        if opts.VaultJWTRole == "" || opts.VaultJWTFile == "" {
+            return nil, fmt.Errorf("--vault-jwt-role and --vault-jwt-file must be used together")
+        }
+
+        auth = vault_token.NewJWTAuth(opts.VaultJWTMount, opts.VaultJWTRole, opts.VaultJWTFile)
+        configured += 1
+    }
+
+    if configured != 1 {
+        return nil, fmt.Errorf("exactly one of --vault-token, --vault-token-file, --vault-approle-role-id, or --vault-jwt-role is required")
+    }
+
+    return auth, nil
+}
+
+func checkError(msg string, err error) {
+    if err != nil {
+        log.Fatalf("%s: %+v", msg, err)
+    }
+}
+
+// parses the command line and runs the service until it fails.  providers are
+// registered in addition to the built-in ones, under their map keys, replacing
+// any built-in provider with the same name.
+func Main(version string, providers map[string]forge.Provider) {
+    var opts Options
+
+    _, err := flags.Parse(&opts)
+    if err != nil {
+        os.Exit(1)
+    }
+
+    if opts.Debug {
+        log.SetLevel(log.DebugLevel)
+    }
+
+    if opts.LogFile != "" {
+        logFp, err := os.OpenFile(opts.LogFile, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+        checkError(fmt.Sprintf("error opening %s", opts.LogFile), err)
+
+        defer logFp.Close()
+
+        // ensure panic output goes to log file
+        syscall.Dup2(int(logFp.Fd()), 1)
+        syscall.Dup2(int(logFp.Fd()), 2)
+
+        // log as JSON
+        log.SetFormatter(&log.JSONFormatter{})
+
+        // send output to file
+        log.SetOutput(logFp)
+    }
+
+    log.Infof("version: %s", version)
+
+    vaultClient, err := vaultapi.NewClient(&vaultapi.Config{
+        Address: opts.VaultAddr,
+    })
+    checkError("creating Vault client", err)
+
+    vaultAuth, err := vaultAuthenticator(opts)
+    checkError("configuring Vault auth", err)
+
+    tokenWatcher := vault_token.NewTokenWatcher(vaultClient)
+
+    if vaultAuth == nil {
+        vaultClient.SetToken(opts.VaultToken)
+    } else {
+        tokenWatcher.SetAuthenticator(vaultAuth)
+        checkError("logging in to Vault", tokenWatcher.Login())
+    }
+
+    nomadClient, err := nomadapi.NewClient(&nomadapi.Config{
+        Address: opts.NomadAddr,
+    })
+    checkError("creating Nomad client", err)
+
+    router := mux.NewRouter()
+
+    tokenWatcher.InstallHandlers(router)
+
+    go tokenWatcher.Run()
+
+    var vault interfaces.VaultLogical = vaultClient.Logical()
+
+    var cache *vault_cache.VaultCache
+    if opts.VaultCacheTTL > 0 {
+        cache = vault_cache.NewVaultCache(vault, opts.VaultCacheTTL, opts.VaultCacheMaxTTL)
+        cache.SetNegativeTTL(opts.VaultCacheNegativeTTL)
+        cache.SetMaxStale(opts.VaultCacheMaxStale)
+        cache.SetMaxEntries(opts.VaultCacheMaxEntries)
+        cache.SetMaxUncachedReads(opts.VaultCacheMaxUncached)
+
+        if opts.AdminToken != "" {
+            adminRouter := mux.NewRouter()
+            cache.InstallHandlers(adminRouter.PathPrefix("/admin/vault-cache").Subrouter())
+
+            router.PathPrefix("/admin/vault-cache").Handler(RequireAdminToken(opts.AdminToken, adminRouter))
+        }
+
+        vault = cache
+    }
+
+    handler := push_handler.NewPushHandler(
+        vault,
+        opts.WebhookTokenPrefix,
+        nomadClient.Jobs(),
+        opts.DispatchJobId,
+    )
+
+    for name, provider := range providers {
+        handler.RegisterProvider(name, provider)
+    }
+
+    kvMount, kvVersion, err := webhookTokenKV(vaultClient.Logical(), opts)
+    checkError("configuring webhook token KV version", err)
+
+    if kvVersion == 2 {
+        log.Infof("reading webhook tokens from KV v2 mount %s", kvMount)
+        checkError("configuring KV v2", handler.UseKVv2(kvMount))
+    } else if kvVersion != 1 {
+        log.Fatalf("unsupported KV version %d", kvVersion)
+    }
+
+    // invalidation takes the paths operators know, not KV v2 data paths
+    if cache != nil {
+        cache.SetPrefixMapper(handler.SecretPath)
+    }
+
+    if opts.DeliveryWindow > 0 {
+        handler.EnableReplayProtection(opts.DeliveryWindow)
+    }
+
+    handler.SetSkipDirectives(opts.SkipCITokens, opts.SkipCIAnyCommit)
+
+    checkError("setting payload schema", handler.SetPayloadSchema(opts.PayloadSchema))
+
+    if opts.PayloadTemplate != "" {
+        tmpl, err := push_handler.ReadPayloadTemplate(opts.PayloadTemplate)
+        checkError("reading payload template", err)
+
+        handler.SetPayloadTemplate(tmpl)
+    }
+
+    if opts.PushMeta {
+        handler.EnablePushMeta()
+    }
+
+    if opts.RulesFile != "" {
+        rules, err := push_handler.ReadRulesFile(opts.RulesFile)
+        checkError("reading rules", err)
+
+        handler.SetDefaultRules(*rules)
+    }
+
+    handler.InstallHandlers(router.PathPrefix("/notify/push").Subrouter())
+
+    httpServer := &http.Server{
+        Addr: fmt.Sprintf(":%d", opts.HttpPort),
+        Handler: Log(router),
+    }
+
+    checkError("launching HTTP server", httpServer.ListenAndServe())
+}